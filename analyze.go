@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func runAnalyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	remotePath := fs.String("remote", "", "")
+	originPath := fs.String("origin", "", "")
+	pcapPath := fs.String("pcap", "", "")
+	dumpFlags := NewDumpFlags(fs)
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s analyze [OPTIONS] [FILE]\n\n", os.Args[0])
+		fmt.Println("Options:")
+		fmt.Println("  --remote:       Raw HTTP/2 byte stream sent by the client")
+		fmt.Println("  --origin:       Raw HTTP/2 byte stream sent by the origin")
+		fmt.Println("  --pcap:         Cleartext HTTP/2 traffic in pcap or pcapng file")
+		dumpFlags.Usage()
+		fmt.Println("  --help:         Display this help and exit.")
+		os.Exit(1)
+	}
+
+	fs.Parse(args)
+
+	var records []*Record
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			logger.Fatalf("Unable to open record file: %s\n", err)
+		}
+		records, err = ReadRecords(f)
+		f.Close()
+		if err != nil {
+			logger.Fatalf("Invalid record file: %s\n", err)
+		}
+	} else if fs.NArg() == 0 && *pcapPath != "" {
+		f, err := os.Open(*pcapPath)
+		if err != nil {
+			logger.Fatalf("Unable to open capture file: %s\n", err)
+		}
+		packets, err := ReadPcap(f)
+		f.Close()
+		if err != nil {
+			logger.Fatalf("Invalid capture file: %s\n", err)
+		}
+		records = PcapRecords(packets)
+	} else if fs.NArg() == 0 && (*remotePath != "" || *originPath != "") {
+		var remote, origin []byte
+		var err error
+		if *remotePath != "" {
+			remote, err = os.ReadFile(*remotePath)
+			if err != nil {
+				logger.Fatalf("Unable to read remote stream: %s\n", err)
+			}
+		}
+		if *originPath != "" {
+			origin, err = os.ReadFile(*originPath)
+			if err != nil {
+				logger.Fatalf("Unable to read origin stream: %s\n", err)
+			}
+		}
+		records = RawRecords(remote, origin)
+	} else {
+		fs.Usage()
+	}
+
+	dumpConfig := dumpFlags.Config()
+	defer dumpConfig.Close()
+
+	analyzer := NewAnalyzer(dumpConfig)
+	for _, rec := range records {
+		analyzer.Analyze(rec)
+	}
+	analyzer.Close()
+}
+
+// Analyzer feeds recorded sessions through the frame dumpers, using the
+// recorded time for every event.
+type Analyzer struct {
+	Dump DumpConfig
+
+	dumpers map[string]*FrameDumper
+	now     int64
+
+	// order holds the connection IDs in the order they were first seen.
+	order []string
+}
+
+func (a *Analyzer) Analyze(rec *Record) {
+	a.now = rec.Time
+
+	dumper, ok := a.dumpers[rec.ConnectionID]
+	if !ok {
+		addr, err := net.ResolveTCPAddr("tcp", rec.RemoteAddr)
+		if err != nil {
+			addr = &net.TCPAddr{IP: net.IPv4zero}
+		}
+
+		dumper = NewFrameDumper(rec.ConnectionID, addr, a.Dump)
+		dumper.Clock = func() int64 {
+			return a.now
+		}
+		dumper.Connect()
+		a.dumpers[rec.ConnectionID] = dumper
+		a.order = append(a.order, rec.ConnectionID)
+	}
+
+	switch rec.Type {
+	case RecordConnect:
+		if rec.Protocol != "" {
+			dumper.DumpConnectionState(tls.ConnectionState{
+				NegotiatedProtocol: rec.Protocol,
+				ServerName:         rec.ServerName,
+			})
+		}
+	case RecordData:
+		dumper.DumpFrame(rec.Data, rec.Remote)
+	case RecordGap:
+		dumper.DumpGap(rec.Length, rec.Skip, rec.Remote)
+	case RecordClose:
+		dumper.Close()
+		delete(a.dumpers, rec.ConnectionID)
+	}
+}
+
+// Close closes the connections whose close record is missing, in the order
+// they were first seen.
+func (a *Analyzer) Close() {
+	for _, id := range a.order {
+		dumper, ok := a.dumpers[id]
+		if !ok {
+			continue
+		}
+		dumper.Close()
+		delete(a.dumpers, id)
+	}
+	a.order = nil
+}
+
+func NewAnalyzer(config DumpConfig) *Analyzer {
+	return &Analyzer{
+		Dump:    config,
+		dumpers: map[string]*FrameDumper{},
+	}
+}
+
+// RawRecords builds a session from the raw byte streams of both directions.
+// Without timing information the frames of both sides are interleaved one by
+// one.
+func RawRecords(remote []byte, origin []byte) []*Record {
+	now := time.Now().UnixNano()
+	addr := &net.TCPAddr{IP: net.IPv4zero}
+	id := NewConnectionID(addr)
+
+	records := []*Record{
+		{Time: now, ConnectionID: id, Type: RecordConnect, Remote: true, RemoteAddr: addr.String()},
+	}
+
+	remoteChunks := splitFrames(remote)
+	originChunks := splitFrames(origin)
+	for len(remoteChunks) > 0 || len(originChunks) > 0 {
+		if len(remoteChunks) > 0 {
+			records = append(records, &Record{Time: now, ConnectionID: id, Type: RecordData, Remote: true, Data: remoteChunks[0]})
+			remoteChunks = remoteChunks[1:]
+		}
+		if len(originChunks) > 0 {
+			records = append(records, &Record{Time: now, ConnectionID: id, Type: RecordData, Remote: false, Data: originChunks[0]})
+			originChunks = originChunks[1:]
+		}
+	}
+
+	records = append(records, &Record{Time: now, ConnectionID: id, Type: RecordClose, Remote: true})
+
+	return records
+}
+
+// splitFrames splits a byte stream into the connection preface and complete
+// frames. Trailing bytes that do not form a complete frame are kept as the
+// last chunk.
+func splitFrames(data []byte) [][]byte {
+	chunks := [][]byte{}
+
+	if bytes.HasPrefix(data, []byte(http2.ClientPreface)) {
+		chunks = append(chunks, data[:len(http2.ClientPreface)])
+		data = data[len(http2.ClientPreface):]
+	}
+
+	for len(data) >= frameHeaderLen {
+		n := frameHeaderLen + int(uint32(data[0])<<16|uint32(data[1])<<8|uint32(data[2]))
+		if n > len(data) {
+			break
+		}
+
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+
+	if len(data) > 0 {
+		chunks = append(chunks, data)
+	}
+
+	return chunks
+}
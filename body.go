@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const bodyIndexFile = "index.jsonl"
+
+// BodyIndexEntry maps the bodies of an exchange back to its header blocks.
+type BodyIndexEntry struct {
+	ConnectionID string     `json:"connection_id"`
+	StreamID     uint32     `json:"stream_id"`
+	Path         string     `json:"path"`
+	Request      *BodyEntry `json:"request,omitempty"`
+	Response     *BodyEntry `json:"response,omitempty"`
+}
+
+type BodyEntry struct {
+	File        string       `json:"file,omitempty"`
+	Size        int          `json:"size"`
+	Saved       int          `json:"saved"`
+	Truncated   bool         `json:"truncated,omitempty"`
+	Encoding    string       `json:"encoding,omitempty"`
+	DecodedSize int          `json:"decoded_size,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Skipped     string       `json:"skipped,omitempty"`
+	Headers     HeaderFields `json:"headers"`
+	Trailers    HeaderFields `json:"trailers,omitempty"`
+}
+
+// BodyWriter saves the request and response bodies of completed exchanges
+// to a directory, together with an index file.
+type BodyWriter struct {
+	Dir      string
+	MaxSize  int
+	TextOnly bool
+
+	mu    sync.Mutex
+	index *os.File
+}
+
+func (bw *BodyWriter) Add(ex *Exchange) {
+	path := ""
+	if ex.Request != nil {
+		path = ex.Request.Headers.Get(":path")
+	}
+
+	entry := BodyIndexEntry{
+		ConnectionID: ex.ConnectionID,
+		StreamID:     ex.StreamID,
+		Path:         path,
+	}
+
+	name := fmt.Sprintf("%s-%d-%s", ex.ConnectionID, ex.StreamID, sanitizeFileName(path))
+	entry.Request = bw.save(ex.Request, name+".request")
+	entry.Response = bw.save(ex.Response, name+".response")
+	if entry.Request == nil && entry.Response == nil {
+		return
+	}
+
+	j, err := json.Marshal(entry)
+	if err != nil {
+		logger.Printf("JSON Error: %s\n", err)
+		return
+	}
+
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	_, err = bw.index.Write(append(j, '\n'))
+	if err != nil {
+		logger.Printf("Unable to write body index: %s", err)
+	}
+}
+
+func (bw *BodyWriter) save(m *Message, name string) *BodyEntry {
+	if m == nil || m.BodySize == 0 {
+		return nil
+	}
+
+	entry := &BodyEntry{
+		Size:     m.BodySize,
+		Headers:  m.Headers,
+		Trailers: m.Trailers,
+	}
+
+	body, size := m.Body, m.BodySize
+	if m.Decoder != nil {
+		entry.Encoding = m.Decoder.Encoding
+		entry.DecodedSize = m.Decoder.DecodedSize
+		if m.Decoder.Err != nil {
+			entry.Error = m.Decoder.Err.Error()
+		} else {
+			body, size = m.Decoder.Decoded, m.Decoder.DecodedSize
+		}
+	}
+
+	if bw.MaxSize > 0 && len(body) > bw.MaxSize {
+		body = body[:bw.MaxSize]
+	}
+	entry.Truncated = len(body) < size
+
+	if bw.TextOnly && !isTextBody(m.Headers.Get("content-type"), body) {
+		entry.Skipped = "binary"
+		return entry
+	}
+
+	err := os.WriteFile(filepath.Join(bw.Dir, name), body, 0644)
+	if err != nil {
+		logger.Printf("Unable to save body: %s", err)
+		entry.Skipped = "error"
+		return entry
+	}
+
+	entry.File = name
+	entry.Saved = len(body)
+
+	return entry
+}
+
+func (bw *BodyWriter) Close() error {
+	return bw.index.Close()
+}
+
+func NewBodyWriter(dir string, maxSize int, textOnly bool) (*BodyWriter, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := os.OpenFile(filepath.Join(dir, bodyIndexFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	bw := &BodyWriter{
+		Dir:      dir,
+		MaxSize:  maxSize,
+		TextOnly: textOnly,
+		index:    index,
+	}
+
+	return bw, nil
+}
+
+// isTextBody reports whether a body is text, judging by its content type or,
+// if there is none, by its content.
+func isTextBody(contentType string, body []byte) bool {
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	if strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-www-form-urlencoded", "application/graphql", "application/yaml",
+		"application/x-ndjson":
+		return true
+	}
+
+	return false
+}
+
+func sanitizeFileName(path string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, path)
+
+	if len(name) > 100 {
+		name = name[:100]
+	}
+
+	return name
+}
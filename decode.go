@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const bodyPreviewSize = 256
+
+// BodyInfo describes a decoded message body.
+type BodyInfo struct {
+	Encoding    string `json:"encoding"`
+	Size        int    `json:"size"`
+	DecodedSize int    `json:"decoded_size"`
+	Preview     string `json:"preview"`
+	Error       string `json:"error,omitempty"`
+}
+
+// BodyDecoder decodes a message body according to its content-encoding as
+// the DATA frames arrive. Decoding runs in its own goroutine that reads the
+// compressed bytes from a pipe.
+type BodyDecoder struct {
+	Encoding    string
+	Size        int
+	DecodedSize int
+	Decoded     []byte
+	Err         error
+
+	maxSize int
+	pw      *io.PipeWriter
+	done    chan struct{}
+}
+
+func (bd *BodyDecoder) Write(p []byte) {
+	bd.Size += len(p)
+
+	// Errors mean that the decoder has stopped, which is reported on Close.
+	bd.pw.Write(p)
+}
+
+// Close waits until all written bytes are decoded.
+func (bd *BodyDecoder) Close() {
+	bd.pw.Close()
+	<-bd.done
+}
+
+func (bd *BodyDecoder) Info() *BodyInfo {
+	preview := bd.Decoded
+	if len(preview) > bodyPreviewSize {
+		preview = preview[:bodyPreviewSize]
+	}
+
+	info := &BodyInfo{
+		Encoding:    bd.Encoding,
+		Size:        bd.Size,
+		DecodedSize: bd.DecodedSize,
+		Preview:     string(preview),
+	}
+	if bd.Err != nil {
+		info.Error = bd.Err.Error()
+	}
+
+	return info
+}
+
+func (bd *BodyDecoder) decode(pr *io.PipeReader, encodings []string) {
+	defer close(bd.done)
+
+	var r io.Reader = pr
+	decoders := []io.ReadCloser{}
+	defer func() {
+		for i := len(decoders) - 1; i >= 0; i-- {
+			decoders[i].Close()
+		}
+	}()
+
+	for i := len(encodings) - 1; i >= 0; i-- {
+		dr, err := newContentDecoder(encodings[i], r)
+		if err != nil {
+			bd.Err = err
+			pr.CloseWithError(err)
+			return
+		}
+		decoders = append(decoders, dr)
+		r = dr
+	}
+
+	buf := make([]byte, 32768)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			bd.DecodedSize += n
+			keep := n
+			if bd.maxSize > 0 && len(bd.Decoded)+keep > bd.maxSize {
+				keep = bd.maxSize - len(bd.Decoded)
+			}
+			bd.Decoded = append(bd.Decoded, buf[:keep]...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			bd.Err = err
+			break
+		}
+	}
+
+	pr.Close()
+}
+
+// newContentDecoder returns a reader that decodes a content-encoding. It must
+// be closed to release the resources of the decoder.
+func newContentDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// Most servers send zlib wrapped data, a few send raw deflate.
+		br := bufio.NewReader(r)
+		header, err := br.Peek(2)
+		if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		// A single body is streamed, so no decoding goroutines are needed.
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case "identity":
+		return io.NopCloser(r), nil
+	}
+
+	return nil, fmt.Errorf("unsupported content-encoding: %s", encoding)
+}
+
+// NewBodyDecoder starts a decoder for a content-encoding header value. It
+// returns nil when the body is not encoded. Up to maxSize decoded bytes are
+// kept, or all of them if maxSize is 0.
+func NewBodyDecoder(contentEncoding string, maxSize int) *BodyDecoder {
+	encodings := []string{}
+	for _, enc := range strings.Split(contentEncoding, ",") {
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		if enc != "" && enc != "identity" {
+			encodings = append(encodings, enc)
+		}
+	}
+	if len(encodings) == 0 {
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	bd := &BodyDecoder{
+		Encoding: strings.Join(encodings, ", "),
+		maxSize:  maxSize,
+		pw:       pw,
+		done:     make(chan struct{}),
+	}
+
+	go bd.decode(pr, encodings)
+
+	return bd
+}
@@ -4,14 +4,16 @@ import (
 	"bytes"
 	"crypto/md5"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/hpack"
 )
 
 func color(color string, msg string) string {
@@ -63,6 +65,60 @@ var flagName = map[http2.FrameType]map[http2.Flags]string{
 	},
 }
 
+// Extension frame types (RFC 7838 and RFC 8336).
+const (
+	FrameAltSvc http2.FrameType = 0xa
+	FrameOrigin http2.FrameType = 0xc
+)
+
+// frameName holds the names of the registered frame types.
+var frameName = map[http2.FrameType]string{
+	http2.FrameData:           "DATA",
+	http2.FrameHeaders:        "HEADERS",
+	http2.FramePriority:       "PRIORITY",
+	http2.FrameRSTStream:      "RST_STREAM",
+	http2.FrameSettings:       "SETTINGS",
+	http2.FramePushPromise:    "PUSH_PROMISE",
+	http2.FramePing:           "PING",
+	http2.FrameGoAway:         "GOAWAY",
+	http2.FrameWindowUpdate:   "WINDOW_UPDATE",
+	http2.FrameContinuation:   "CONTINUATION",
+	FrameAltSvc:               "ALTSVC",
+	FrameOrigin:               "ORIGIN",
+	http2.FramePriorityUpdate: "PRIORITY_UPDATE",
+}
+
+// settingName holds the names of the registered SETTINGS parameters.
+var settingName = map[http2.SettingID]string{
+	http2.SettingHeaderTableSize:       "HEADER_TABLE_SIZE",
+	http2.SettingEnablePush:            "ENABLE_PUSH",
+	http2.SettingMaxConcurrentStreams:  "MAX_CONCURRENT_STREAMS",
+	http2.SettingInitialWindowSize:     "INITIAL_WINDOW_SIZE",
+	http2.SettingMaxFrameSize:          "MAX_FRAME_SIZE",
+	http2.SettingMaxHeaderListSize:     "MAX_HEADER_LIST_SIZE",
+	http2.SettingEnableConnectProtocol: "ENABLE_CONNECT_PROTOCOL",
+	http2.SettingNoRFC7540Priorities:   "NO_RFC7540_PRIORITIES",
+	0x10:                               "TLS_RENEG_PERMITTED",
+}
+
+func frameTypeName(t http2.FrameType) string {
+	name, ok := frameName[t]
+	if !ok {
+		return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", t)
+	}
+
+	return name
+}
+
+func settingIDName(id http2.SettingID) string {
+	name, ok := settingName[id]
+	if !ok {
+		return fmt.Sprintf("UNKNOWN_SETTING_%d", id)
+	}
+
+	return name
+}
+
 type Formatter int
 
 const (
@@ -75,6 +131,12 @@ type FrameDumper struct {
 	RemoteAddr net.Addr
 	Formatter  Formatter
 
+	// HPACK adds the dynamic table to the frames that end a header block.
+	HPACK bool
+
+	// Clock returns the time of the events in nanoseconds.
+	Clock func() int64
+
 	start int64
 
 	remoteFramer *Framer
@@ -83,38 +145,101 @@ type FrameDumper struct {
 	remoteFlowController *FlowController
 	originFlowController *FlowController
 
+	// problems are found while dumping a frame, before the frame is linted.
+	problems []Problem
+
+	streams    *StreamTracker
+	priorities *PriorityTree
+	urgencies  *ExtensiblePriorities
+	linter     *Linter
+	exchanges  *ExchangeTracker
+
+	// http1 is set when the connection carries HTTP/1.x instead of HTTP/2.
+	// Until the protocol of a cleartext connection is known, the first bytes
+	// of the client are held in prefix.
+	http1    *HTTP1Parser
+	detected bool
+	prefix   []byte
+
 	indent string
 }
 
 func (fd *FrameDumper) Connect() {
-	e := NewEvent(EventConnect, true, fd.RemoteAddr, fd.ID, 0, 0)
+	e := NewEvent(EventConnect, true, fd.RemoteAddr, fd.ID, 0, fd.Clock(), 0)
 	e.Message = "Connected"
 	fd.PrintEvent(e)
 	fd.start = e.Time
 }
 
 func (fd *FrameDumper) Close() {
-	e := NewEvent(EventClose, true, fd.RemoteAddr, fd.ID, 0, fd.start)
+	if fd.http1 != nil {
+		fd.DumpHTTP1Parts(fd.http1.Close())
+	}
+
+	if fd.exchanges != nil {
+		fd.exchanges.Close()
+	}
+
+	e := NewEvent(EventClose, true, fd.RemoteAddr, fd.ID, 0, fd.Clock(), fd.start)
+	fd.DumpProblems(e, fd.linter.Close())
+
 	e.Message = "Closed"
+	e.OpenStreams = fd.streams.OpenStreams()
+	e.StallTimes = fd.stallTimes(e.Time)
+	if fd.priorities != nil && !fd.priorities.Empty() {
+		e.PriorityTree = fd.priorities.Root()
+	}
 	fd.PrintEvent(e)
 }
 
 func (fd *FrameDumper) DumpConnectionState(state tls.ConnectionState) {
-	e := NewEvent(EventConnectionState, true, fd.RemoteAddr, fd.ID, 0, fd.start)
+	e := NewEvent(EventConnectionState, true, fd.RemoteAddr, fd.ID, 0, fd.Clock(), fd.start)
 	e.State = NewState(state.NegotiatedProtocol)
 	fd.PrintEvent(e)
+
+	if state.NegotiatedProtocol == "http/1.1" {
+		fd.http1 = NewHTTP1Parser("https")
+	}
 }
 
 func (fd *FrameDumper) DumpFrame(chunk []byte, remote bool) {
+	if remote && !fd.detected && fd.http1 == nil {
+		fd.prefix = append(fd.prefix, chunk...)
+
+		n := len(fd.prefix)
+		if n > len(http2.ClientPreface) {
+			n = len(http2.ClientPreface)
+		}
+		if string(fd.prefix[:n]) == http2.ClientPreface[:n] && n < len(http2.ClientPreface) {
+			return
+		}
+
+		// A client that starts with a request line instead of the
+		// connection preface speaks HTTP/1.1, and may upgrade to h2c later.
+		fd.detected = true
+		chunk, fd.prefix = fd.prefix, nil
+		if string(chunk[:n]) != http2.ClientPreface[:n] && isHTTP1Request(chunk) {
+			fd.http1 = NewHTTP1Parser("http")
+		}
+	}
+
+	if fd.http1 != nil {
+		fd.DumpHTTP1(chunk, remote)
+		return
+	}
+
 	callback := func(frame http2.Frame) error {
-		e := NewEvent(EventFrame, remote, fd.RemoteAddr, fd.ID, frame.Header().StreamID, fd.start)
+		e := NewEvent(EventFrame, remote, fd.RemoteAddr, fd.ID, frame.Header().StreamID, fd.Clock(), fd.start)
 		e.Frame = fd.DumpFrameHeader(frame, remote)
 
+		// A header block that cannot be decoded is reported after its frame.
+		var headerErr *FrameError
+
 		switch frame := frame.(type) {
 		case *http2.DataFrame:
 			e.Frame.Payload = fd.DumpDataFrame(frame, remote)
 		case *http2.HeadersFrame:
-			e.Frame.Payload = fd.DumpHeadersFrame(frame, remote)
+			e.Frame.Payload, headerErr = fd.DumpHeadersFrame(frame, remote)
 		case *http2.PriorityFrame:
 			e.Frame.Payload = fd.DumpPriorityFrame(frame, remote)
 		case *http2.RSTStreamFrame:
@@ -122,7 +247,7 @@ func (fd *FrameDumper) DumpFrame(chunk []byte, remote bool) {
 		case *http2.SettingsFrame:
 			e.Frame.Payload = fd.DumpSettingsFrame(frame, remote)
 		case *http2.PushPromiseFrame:
-			e.Frame.Payload = fd.DumpPushPromiseFrame(frame, remote)
+			e.Frame.Payload, headerErr = fd.DumpPushPromiseFrame(frame, remote)
 		case *http2.PingFrame:
 			e.Frame.Payload = fd.DumpPingFrame(frame, remote)
 		case *http2.GoAwayFrame:
@@ -130,21 +255,283 @@ func (fd *FrameDumper) DumpFrame(chunk []byte, remote bool) {
 		case *http2.WindowUpdateFrame:
 			e.Frame.Payload = fd.DumpWindowUpdateFrame(frame, remote)
 		case *http2.ContinuationFrame:
-			e.Frame.Payload = fd.DumpContinuationFrame(frame, remote)
+			e.Frame.Payload, headerErr = fd.DumpContinuationFrame(frame, remote)
+		case *http2.PriorityUpdateFrame:
+			e.Frame.Payload = fd.DumpPriorityUpdateFrame(frame, remote)
+		case *http2.UnknownFrame:
+			e.Frame.Payload = fd.DumpUnknownFrame(frame, remote)
+		}
+
+		problems := fd.problems
+		fd.problems = nil
+
+		var streamProblems []Problem
+		e.Stream, streamProblems = fd.streams.HandleFrame(frame, remote)
+		problems = append(problems, streamProblems...)
+		problems = append(problems, fd.linter.HandleFrame(e, frame, remote)...)
+
+		stalls := fd.DumpStalls(e, frame, remote)
+
+		priorityChanged := false
+		if fd.priorities != nil {
+			priorityChanged = fd.priorities.HandleFrame(frame)
+		}
+		e.Priority = fd.urgencies.HandleFrame(e, frame, remote)
+
+		if e.Stream != nil && e.Stream.Client.State == StreamClosed {
+			fd.remoteFlowController.CloseStream(e.StreamID, e.Time)
+			fd.originFlowController.CloseStream(e.StreamID, e.Time)
+			fd.urgencies.Remove(e.StreamID)
+			if fd.priorities != nil && fd.priorities.Remove(e.StreamID) {
+				priorityChanged = true
+			}
+		}
+
+		if priorityChanged {
+			e.PriorityTree = fd.priorities.Root()
+		}
+
+		if fd.HPACK && headersEnded(frame) {
+			if remote {
+				e.HPACK = fd.remoteFramer.HeaderTable()
+			} else {
+				e.HPACK = fd.originFramer.HeaderTable()
+			}
+		}
+
+		events := []*Event{}
+		if fd.exchanges != nil {
+			events = fd.exchanges.HandleFrame(e, frame)
 		}
 
 		fd.PrintEvent(e)
+		if headerErr != nil {
+			fd.DumpFrameError(headerErr, remote)
+		}
+		fd.DumpProblems(e, problems)
+		for _, se := range stalls {
+			fd.PrintEvent(se)
+		}
+		for _, de := range events {
+			fd.PrintEvent(de)
+		}
 
 		return nil
 	}
 
+	errCallback := func(fe *FrameError) {
+		fd.DumpFrameError(fe, remote)
+	}
+
+	if remote {
+		fd.remoteFramer.ReadFrame(chunk, callback, errCallback)
+	} else {
+		fd.originFramer.ReadFrame(chunk, callback, errCallback)
+	}
+}
+
+// DumpFrameError prints bytes that the framer skipped as an error event, on
+// the stream of the frame when it is known. Frames larger than
+// SETTINGS_MAX_FRAME_SIZE also carry the problem of the frame-size rule.
+func (fd *FrameDumper) DumpFrameError(fe *FrameError, remote bool) {
+	var streamID uint32
+	if fe.Header != nil {
+		streamID = fe.Header.StreamID
+	}
+
+	e := NewEvent(EventError, remote, fd.RemoteAddr, fd.ID, streamID, fd.Clock(), fd.start)
+	e.FrameError = fe
+
+	_, ok := fe.Err.(*FrameSizeError)
+	if ok {
+		problems := fd.linter.Filter([]Problem{newProblem("frame-size", "%s", fe.Message)})
+		if len(problems) > 0 {
+			e.Problem = &problems[0]
+		}
+	}
+
+	fd.PrintEvent(e)
+}
+
+// DumpGap reports bytes of a side that are missing from a capture. The frame
+// they cut and the skip bytes after them are skipped, and reading goes on
+// with the next chunk.
+func (fd *FrameDumper) DumpGap(missing int64, skip int64, remote bool) {
+	f := fd.originFramer
 	if remote {
-		fd.remoteFramer.ReadFrame(chunk, callback)
+		f = fd.remoteFramer
+	}
+
+	fd.DumpFrameError(f.Gap(missing, skip), remote)
+}
+
+// DumpHTTP1 dumps a chunk of an HTTP/1.x connection as the messages it
+// carries.
+func (fd *FrameDumper) DumpHTTP1(chunk []byte, remote bool) {
+	parts, fe := fd.http1.Read(chunk, remote)
+	fd.DumpHTTP1Parts(parts)
+	if fe != nil {
+		fd.DumpFrameError(fe, remote)
+	}
+
+	if fd.http1.H2C {
+		fd.UpgradeH2C()
+	}
+}
+
+// UpgradeH2C switches a connection that was upgraded from HTTP/1.1 to HTTP/2
+// (RFC 7540, Section 3.2). The upgrade request is stream 1, which the client
+// has ended, and its HTTP2-Settings header field is the first SETTINGS of the
+// client, acknowledged by the 101 response. The bytes that follow the upgrade
+// are dumped as frames.
+func (fd *FrameDumper) UpgradeH2C() {
+	p := fd.http1
+	fd.http1 = nil
+
+	req := p.UpgradeRequest
+	if req == nil {
+		req = &HTTP1Message{}
+	}
+	fd.streams.Upgrade()
+	fd.linter.Upgrade(req.Method)
+
+	frame, err := req.HTTP2Settings()
+	if err != nil {
+		fd.DumpFrameError(&FrameError{Offset: req.offset, Message: err.Error()}, true)
 	} else {
-		fd.originFramer.ReadFrame(chunk, callback)
+		e := NewEvent(EventFrame, true, fd.RemoteAddr, fd.ID, 0, fd.Clock(), fd.start)
+		e.Frame = fd.DumpFrameHeader(frame, true)
+		e.Frame.Payload = fd.DumpSettingsFrame(frame, true)
+		fd.PrintEvent(e)
+	}
+
+	remote, origin := p.Rest(true), p.Rest(false)
+	if len(remote) > 0 {
+		fd.DumpFrame(remote, true)
+	}
+	if len(origin) > 0 {
+		fd.DumpFrame(origin, false)
 	}
 }
 
+// DumpHTTP1Parts prints an event for the header section and the body of each
+// message, and adds them to the exchanges.
+func (fd *FrameDumper) DumpHTTP1Parts(parts []HTTP1Part) {
+	for _, part := range parts {
+		m := *part.Message
+
+		eventType := EventHTTP1Body
+		if part.Headers {
+			eventType = EventHTTP1Message
+		}
+		e := NewEvent(eventType, part.Remote, fd.RemoteAddr, fd.ID, part.StreamID, fd.Clock(), fd.start)
+		e.HTTP1 = &m
+
+		events := []*Event{}
+		switch {
+		case part.Headers:
+			if fd.exchanges != nil {
+				fd.exchanges.HandleMessageHeaders(e, m.Version, m.HeaderFields(fd.http1.Scheme))
+			}
+			fd.PrintEvent(e)
+
+		case part.End:
+			if fd.exchanges != nil {
+				fd.exchanges.HandleMessageEnd(e, m.Trailers)
+			}
+			// Messages without a body end with their header section.
+			if m.Framing != HTTP1FramingNone {
+				fd.PrintEvent(e)
+			}
+
+		default:
+			if fd.exchanges != nil {
+				events = fd.exchanges.HandleMessageData(e, part.Data)
+			}
+		}
+
+		for _, de := range events {
+			fd.PrintEvent(de)
+		}
+	}
+}
+
+// DumpProblems prints the problems of enabled lint rules as warning or
+// error events that happened along with e.
+func (fd *FrameDumper) DumpProblems(e *Event, problems []Problem) {
+	for _, p := range fd.linter.Filter(problems) {
+		eventType := EventWarning
+		if p.Severity == SeverityError {
+			eventType = EventError
+		}
+
+		pe := e.Derive(eventType)
+		pe.Problem = &p
+		fd.PrintEvent(pe)
+	}
+}
+
+// DumpStalls follows what the sender of a frame has left to send, and returns
+// the events of the windows that reached zero or reopened with the frame.
+func (fd *FrameDumper) DumpStalls(e *Event, frame http2.Frame, remote bool) []*Event {
+	// The DATA of the sender is limited by the windows of the other side,
+	// and WINDOW_UPDATE and SETTINGS change the windows of the sender.
+	sendFC, recvFC := fd.originFlowController, fd.remoteFlowController
+	if !remote {
+		sendFC, recvFC = recvFC, sendFC
+	}
+	streamID := frame.Header().StreamID
+
+	stalls := []*FlowStall{}
+	switch frame := frame.(type) {
+	case *http2.HeadersFrame:
+		p := e.Frame.Payload.(HeadersFramePayload)
+		setContentLength(sendFC, streamID, p.HeaderFields)
+		if frame.StreamEnded() {
+			sendFC.EndStream(streamID, e.Time)
+		}
+
+	case *http2.ContinuationFrame:
+		p := e.Frame.Payload.(ContinuationFramePayload)
+		setContentLength(sendFC, streamID, p.HeaderFields)
+
+	case *http2.DataFrame:
+		sendFC.SendData(streamID, int64(len(frame.Data())))
+		if frame.StreamEnded() {
+			sendFC.EndStream(streamID, e.Time)
+		}
+		stalls = sendFC.Stalls(e.Time, streamID)
+
+	case *http2.WindowUpdateFrame:
+		if streamID == 0 {
+			stalls = recvFC.Stalls(e.Time)
+		} else {
+			stalls = recvFC.Stalls(e.Time, streamID)
+		}
+
+	case *http2.SettingsFrame:
+		_, ok := frame.Value(http2.SettingInitialWindowSize)
+		if ok {
+			stalls = recvFC.Stalls(e.Time, recvFC.StreamIDs()...)
+		}
+	}
+
+	events := make([]*Event, 0, len(stalls))
+	for _, stall := range stalls {
+		eventType := EventFlowStall
+		if stall.resumed {
+			eventType = EventFlowResume
+		}
+
+		se := e.Derive(eventType)
+		se.StreamID = stall.streamID
+		se.Stall = stall
+		events = append(events, se)
+	}
+
+	return events
+}
+
 func (fd *FrameDumper) DumpFrameHeader(frame http2.Frame, remote bool) *Frame {
 	header := frame.Header()
 
@@ -152,7 +539,7 @@ func (fd *FrameDumper) DumpFrameHeader(frame http2.Frame, remote bool) *Frame {
 	f.Length = header.Length
 	f.Type = FrameNameID{
 		ID:   uint8(header.Type),
-		Name: header.Type.String(),
+		Name: frameTypeName(header.Type),
 	}
 
 	frameFlags := header.Flags
@@ -176,23 +563,29 @@ func (fd *FrameDumper) DumpDataFrame(frame *http2.DataFrame, remote bool) DataFr
 	p := DataFramePayload{}
 	p.WindowSize = FrameWindowSize{}
 
-	size := uint32(len(frame.Data()))
+	// Padding counts against the windows, so the whole payload is used.
+	size := int64(frame.Header().Length)
 	streamID := frame.Header().StreamID
 
+	var f *Framer
 	var fc *FlowController
 	if remote {
+		f = fd.remoteFramer
 		fc = fd.originFlowController
 	} else {
+		f = fd.originFramer
 		fc = fd.remoteFlowController
 	}
 
+	p.Padding = f.Padding(frame)
 	p.WindowSize.Connection = fc.UpdateConnectionWindow(-size)
 	p.WindowSize.Stream = fc.UpdateStreamWindow(streamID, -size)
+	p.StreamWindows = fd.streamWindows(streamID)
 
 	return p
 }
 
-func (fd *FrameDumper) DumpHeadersFrame(frame *http2.HeadersFrame, remote bool) HeadersFramePayload {
+func (fd *FrameDumper) DumpHeadersFrame(frame *http2.HeadersFrame, remote bool) (HeadersFramePayload, *FrameError) {
 	p := HeadersFramePayload{}
 	p.Priority = frame.HasPriority()
 
@@ -210,15 +603,24 @@ func (fd *FrameDumper) DumpHeadersFrame(frame *http2.HeadersFrame, remote bool)
 		f = fd.originFramer
 	}
 
-	hf := frame.HeaderBlockFragment()
-	f.ReadHeader(hf, func(header hpack.HeaderField) {
-		if p.HeaderFields == nil {
-			p.HeaderFields = map[string]string{}
-		}
-		p.HeaderFields[header.Name] = header.Value
-	})
+	p.Padding = f.Padding(frame)
+	var fe *FrameError
+	p.HeaderFields, p.Fragments, fe = fd.readHeader(f, frame, frame.HeaderBlockFragment(), frame.HeadersEnded())
 
-	return p
+	return p, fe
+}
+
+// readHeader adds a header block fragment to the framer of a side. A header
+// block that cannot be decoded is returned as an error on the frame that ends
+// it.
+func (fd *FrameDumper) readHeader(f *Framer, frame http2.Frame, fragment []byte, end bool) (HeaderFields, []int, *FrameError) {
+	fields, fragments, fe := f.ReadHeader(fragment, end)
+	if fe != nil {
+		header := frame.Header()
+		fe.Header = &header
+	}
+
+	return fields, fragments, fe
 }
 
 func (fd *FrameDumper) DumpPriorityFrame(frame *http2.PriorityFrame, remote bool) PriorityFramePayload {
@@ -250,23 +652,47 @@ func (fd *FrameDumper) DumpSettingsFrame(frame *http2.SettingsFrame, remote bool
 	windowSize, ok := frame.Value(http2.SettingInitialWindowSize)
 	if ok {
 		var fc *FlowController
+		var peer string
 		if remote {
 			fc = fd.remoteFlowController
+			peer = "server"
 		} else {
 			fc = fd.originFlowController
+			peer = "client"
+		}
+		for _, streamID := range fc.SetInitialWindowSize(windowSize) {
+			fd.problems = append(fd.problems, newProblem("flow-control", "SETTINGS_INITIAL_WINDOW_SIZE makes the window of stream %d for %s exceed %d", streamID, peer, maxWindowSize))
 		}
-		fc.InitialWindowSize = windowSize
 	}
 
+	// A server that does not use RFC 7540 priorities ignores the priority
+	// tree.
+	noRFC7540Priorities, ok := frame.Value(http2.SettingNoRFC7540Priorities)
+	if ok && !remote && noRFC7540Priorities == 1 && fd.priorities != nil {
+		fd.priorities.Disabled = true
+	}
+
+	// The setting limits the header blocks sent by the other side.
 	tableSize, ok := frame.Value(http2.SettingHeaderTableSize)
 	if ok {
 		var f *Framer
 		if remote {
+			f = fd.originFramer
+		} else {
 			f = fd.remoteFramer
+		}
+		f.SetHeaderTableSize(tableSize)
+	}
+
+	// The setting limits the frames sent by the other side. Values out of
+	// range are reported by the linter and ignored.
+	frameSize, ok := frame.Value(http2.SettingMaxFrameSize)
+	if ok && frameSize >= defaultMaxFrameSize && frameSize <= maxFrameSize {
+		if remote {
+			fd.originFramer.SetMaxFrameSize(frameSize)
 		} else {
-			f = fd.originFramer
+			fd.remoteFramer.SetMaxFrameSize(frameSize)
 		}
-		f.SetMaxDynamicTableSize(tableSize)
 	}
 
 	frame.ForeachSetting(func(setting http2.Setting) error {
@@ -275,7 +701,7 @@ func (fd *FrameDumper) DumpSettingsFrame(frame *http2.SettingsFrame, remote bool
 		}
 
 		fs := FrameSetting{
-			Name:  setting.ID.String(),
+			Name:  settingIDName(setting.ID),
 			Value: setting.Val,
 			ID:    uint16(setting.ID),
 		}
@@ -287,7 +713,7 @@ func (fd *FrameDumper) DumpSettingsFrame(frame *http2.SettingsFrame, remote bool
 	return p
 }
 
-func (fd *FrameDumper) DumpPushPromiseFrame(frame *http2.PushPromiseFrame, remote bool) PushPromiseFramePayload {
+func (fd *FrameDumper) DumpPushPromiseFrame(frame *http2.PushPromiseFrame, remote bool) (PushPromiseFramePayload, *FrameError) {
 	p := PushPromiseFramePayload{}
 	p.PromisedStreamID = frame.PromiseID
 
@@ -298,15 +724,11 @@ func (fd *FrameDumper) DumpPushPromiseFrame(frame *http2.PushPromiseFrame, remot
 		f = fd.originFramer
 	}
 
-	hf := frame.HeaderBlockFragment()
-	f.ReadHeader(hf, func(header hpack.HeaderField) {
-		if p.HeaderFields == nil {
-			p.HeaderFields = map[string]string{}
-		}
-		p.HeaderFields[header.Name] = header.Value
-	})
+	p.Padding = f.Padding(frame)
+	var fe *FrameError
+	p.HeaderFields, p.Fragments, fe = fd.readHeader(f, frame, frame.HeaderBlockFragment(), frame.HeadersEnded())
 
-	return p
+	return p, fe
 }
 
 func (fd *FrameDumper) DumpPingFrame(frame *http2.PingFrame, remote bool) PingFramePayload {
@@ -342,18 +764,45 @@ func (fd *FrameDumper) DumpWindowUpdateFrame(frame *http2.WindowUpdateFrame, rem
 		fc = fd.originFlowController
 	}
 
-	size := uint32(frame.Increment)
+	size := int64(frame.Increment)
 	streamID := frame.Header().StreamID
 	if streamID == 0 {
 		p.WindowSize.Connection = fc.UpdateConnectionWindow(size)
 	} else {
 		p.WindowSize.Stream = fc.UpdateStreamWindow(streamID, size)
+		p.StreamWindows = fd.streamWindows(streamID)
+	}
+
+	return p
+}
+
+// streamWindows returns the windows of a stream in both directions.
+func (fd *FrameDumper) streamWindows(streamID uint32) *StreamWindows {
+	return &StreamWindows{
+		Client: FrameWindowSize{
+			Connection: WindowSize{current: fd.originFlowController.ConnectionWindowSize},
+			Stream:     WindowSize{current: fd.originFlowController.StreamWindow(streamID)},
+		},
+		Server: FrameWindowSize{
+			Connection: WindowSize{current: fd.remoteFlowController.ConnectionWindowSize},
+			Stream:     WindowSize{current: fd.remoteFlowController.StreamWindow(streamID)},
+		},
 	}
+}
+
+func (fd *FrameDumper) DumpPriorityUpdateFrame(frame *http2.PriorityUpdateFrame, remote bool) PriorityUpdateFramePayload {
+	p := PriorityUpdateFramePayload{}
+	p.PrioritizedStreamID = frame.PrioritizedStreamID
+	p.PriorityFieldValue = frame.Priority
+
+	priority := parsePriority(frame.Priority, NewStreamPriority(frame.PrioritizedStreamID))
+	p.Urgency = priority.Urgency
+	p.Incremental = priority.Incremental
 
 	return p
 }
 
-func (fd *FrameDumper) DumpContinuationFrame(frame *http2.ContinuationFrame, remote bool) ContinuationFramePayload {
+func (fd *FrameDumper) DumpContinuationFrame(frame *http2.ContinuationFrame, remote bool) (ContinuationFramePayload, *FrameError) {
 	p := ContinuationFramePayload{}
 
 	var f *Framer
@@ -363,15 +812,35 @@ func (fd *FrameDumper) DumpContinuationFrame(frame *http2.ContinuationFrame, rem
 		f = fd.originFramer
 	}
 
-	hf := frame.HeaderBlockFragment()
-	f.ReadHeader(hf, func(header hpack.HeaderField) {
-		if p.HeaderFields == nil {
-			p.HeaderFields = map[string]string{}
+	var fe *FrameError
+	p.HeaderFields, p.Fragments, fe = fd.readHeader(f, frame, frame.HeaderBlockFragment(), frame.HeadersEnded())
+
+	return p, fe
+}
+
+// DumpUnknownFrame decodes the extension frames that are not known to http2,
+// and shows the raw content of other frames.
+func (fd *FrameDumper) DumpUnknownFrame(frame *http2.UnknownFrame, remote bool) FramePayload {
+	payload := frame.Payload()
+
+	switch frame.Type {
+	case FrameAltSvc:
+		p, err := parseAltSvcFrame(payload)
+		if err == nil {
+			return p
 		}
-		p.HeaderFields[header.Name] = header.Value
-	})
+	case FrameOrigin:
+		p, err := parseOriginFrame(payload)
+		if err == nil {
+			return p
+		}
+	}
 
-	return p
+	return UnknownFramePayload{
+		Type:    uint8(frame.Type),
+		Flags:   uint8(frame.Flags),
+		Payload: hex.EncodeToString(payload),
+	}
 }
 
 func (fd *FrameDumper) PrintEvent(e *Event) {
@@ -390,6 +859,18 @@ func (fd *FrameDumper) PrintEvent(e *Event) {
 		fd.PrintFrame(e)
 	case EventConnectionState:
 		fd.PrintConnectionState(e)
+	case EventClose:
+		fd.PrintClose(e)
+	case EventWarning, EventError:
+		fd.PrintProblem(e)
+	case EventGRPCMessage:
+		fd.PrintGRPCMessage(e)
+	case EventGRPCStatus:
+		fd.PrintGRPCStatus(e)
+	case EventFlowStall, EventFlowResume:
+		fd.PrintStall(e)
+	case EventHTTP1Message, EventHTTP1Body:
+		fd.PrintHTTP1Message(e)
 	default:
 		fd.PrintMessage(e.StreamID, e.Message, nil, e.Remote)
 	}
@@ -419,12 +900,15 @@ func (fd *FrameDumper) PrintFrame(e *Event) {
 
 	switch payload := frame.Payload.(type) {
 	case DataFramePayload:
+		data = append(data, paddingLines(payload.Padding)...)
+
 		var size WindowSize
 		data = append(data, "Window Size:")
 		size = payload.WindowSize.Connection
 		data = append(data, fmt.Sprintf("  Connection: %d (%d)", size.current, size.delta))
 		size = payload.WindowSize.Stream
 		data = append(data, fmt.Sprintf("  Stream: %d (%d)", size.current, size.delta))
+		data = append(data, streamWindowLines(payload.StreamWindows)...)
 
 	case HeadersFramePayload:
 		if payload.Priority {
@@ -441,12 +925,8 @@ func (fd *FrameDumper) PrintFrame(e *Event) {
 			data = append(data, fmt.Sprintf("Exclusive: %s", exclusive))
 		}
 
-		if len(payload.HeaderFields) > 0 {
-			data = append(data, "Header Fields:")
-			for k, v := range payload.HeaderFields {
-				data = append(data, fmt.Sprintf("  %s: %s", k, v))
-			}
-		}
+		data = append(data, paddingLines(payload.Padding)...)
+		data = append(data, headerBlockLines(payload.FrameHeaderFields)...)
 
 	case PriorityFramePayload:
 		var exclusive string
@@ -468,18 +948,14 @@ func (fd *FrameDumper) PrintFrame(e *Event) {
 		if len(payload.Parameters) > 0 {
 			data = append(data, "Parameters:")
 			for _, s := range payload.Parameters {
-				data = append(data, fmt.Sprintf("  %s (0x%d): %d", s.Name, s.ID, s.Value))
+				data = append(data, fmt.Sprintf("  %s (0x%x): %d", s.Name, s.ID, s.Value))
 			}
 		}
 
 	case PushPromiseFramePayload:
 		data = append(data, fmt.Sprintf("Promised Stream ID: %d", payload.PromisedStreamID))
-		if len(payload.HeaderFields) > 0 {
-			data = append(data, "Header Fields:")
-			for k, v := range payload.HeaderFields {
-				data = append(data, fmt.Sprintf("  %s: %s", k, v))
-			}
-		}
+		data = append(data, paddingLines(payload.Padding)...)
+		data = append(data, headerBlockLines(payload.FrameHeaderFields)...)
 
 	case PingFramePayload:
 		if len(payload.OpaqueData) > 0 {
@@ -500,24 +976,422 @@ func (fd *FrameDumper) PrintFrame(e *Event) {
 		data = append(data, fmt.Sprintf("  Connection: %d (%d)", size.current, size.delta))
 		size = payload.WindowSize.Stream
 		data = append(data, fmt.Sprintf("  Stream: %d (%d)", size.current, size.delta))
+		data = append(data, streamWindowLines(payload.StreamWindows)...)
 
 	case ContinuationFramePayload:
-		if len(payload.HeaderFields) > 0 {
-			data = append(data, "Header Fields:")
-			for k, v := range payload.HeaderFields {
-				data = append(data, fmt.Sprintf("  %s: %s", k, v))
+		data = append(data, headerBlockLines(payload.FrameHeaderFields)...)
+
+	case AltSvcFramePayload:
+		if payload.Origin != "" {
+			data = append(data, fmt.Sprintf("Origin: %s", payload.Origin))
+		}
+		data = append(data, fmt.Sprintf("Alt-Svc: %s", payload.FieldValue))
+
+	case OriginFramePayload:
+		data = append(data, "Origins:")
+		for _, origin := range payload.Origins {
+			data = append(data, fmt.Sprintf("  - %s", origin))
+		}
+
+	case UnknownFramePayload:
+		data = append(data, fmt.Sprintf("Type: 0x%x", payload.Type))
+		data = append(data, fmt.Sprintf("Flags: 0x%x", payload.Flags))
+		if payload.Payload != "" {
+			b, _ := hex.DecodeString(payload.Payload)
+			data = append(data, "Payload:")
+			for _, line := range strings.Split(strings.TrimSuffix(hex.Dump(b), "\n"), "\n") {
+				data = append(data, "  "+line)
 			}
 		}
+
+	case PriorityUpdateFramePayload:
+		data = append(data, fmt.Sprintf("Prioritized Stream ID: %d", payload.PrioritizedStreamID))
+		data = append(data, fmt.Sprintf("Priority Field Value: %s", payload.PriorityFieldValue))
+	}
+
+	if e.Priority != nil {
+		var incremental string
+
+		if e.Priority.Incremental {
+			incremental = "Yes"
+		} else {
+			incremental = "No"
+		}
+
+		data = append(data, "Priority:")
+		data = append(data, fmt.Sprintf("  Urgency: %d", e.Priority.Urgency))
+		data = append(data, fmt.Sprintf("  Incremental: %s", incremental))
+	}
+
+	if e.Body != nil {
+		data = append(data, bodyInfoLines(e.Body)...)
+	}
+
+	if e.Stream != nil {
+		data = append(data, "Stream State:")
+		data = append(data, fmt.Sprintf("  Client: %s", e.Stream.Client))
+		data = append(data, fmt.Sprintf("  Server: %s", e.Stream.Server))
+	}
+
+	if e.PriorityTree != nil {
+		data = append(data, "Priority Tree:")
+		data = append(data, priorityTreeLines(e.PriorityTree)...)
+	}
+
+	if e.HPACK != nil {
+		data = append(data, "Dynamic Table:")
+		data = append(data, fmt.Sprintf("  Size: %d/%d (Limit: %d)", e.HPACK.Size, e.HPACK.MaxSize, e.HPACK.Limit))
+		for _, size := range e.HPACK.SizeUpdates {
+			data = append(data, fmt.Sprintf("  Size Update: %d", size))
+		}
+		for _, entry := range e.HPACK.Entries {
+			data = append(data, fmt.Sprintf("  [%d] %s: %s (%d)", entry.Index, entry.Name, entry.Value, entry.Size))
+		}
+		for _, entry := range e.HPACK.Evicted {
+			data = append(data, fmt.Sprintf("  Evicted [%d] %s: %s (%d)", entry.Index, entry.Name, entry.Value, entry.Size))
+		}
 	}
 
 	fd.PrintMessage(e.StreamID, msg, data, e.Remote)
 }
 
+// stallTimes returns the total stall time of each stream that stalled, in
+// order.
+func (fd *FrameDumper) stallTimes(now int64) []StallSummary {
+	client := fd.originFlowController.StallTimes(now)
+	server := fd.remoteFlowController.StallTimes(now)
+
+	summaries := []StallSummary{}
+	for streamID, d := range client {
+		summaries = append(summaries, StallSummary{StreamID: streamID, Client: d, Server: server[streamID]})
+	}
+	for streamID, d := range server {
+		_, ok := client[streamID]
+		if !ok {
+			summaries = append(summaries, StallSummary{StreamID: streamID, Server: d})
+		}
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].StreamID < summaries[j].StreamID
+	})
+
+	return summaries
+}
+
+// setContentLength records the size of the message that a header block
+// announces.
+func setContentLength(fc *FlowController, streamID uint32, headers HeaderFields) {
+	length, err := strconv.ParseInt(headers.Get("content-length"), 10, 64)
+	if err == nil && length >= 0 {
+		fc.SetContentLength(streamID, length)
+	}
+}
+
+func paddingLines(padding *FramePadding) []string {
+	if padding == nil {
+		return nil
+	}
+
+	var nonZero string
+	if padding.NonZero {
+		nonZero = "Yes"
+	} else {
+		nonZero = "No"
+	}
+
+	return []string{
+		"Padding:",
+		fmt.Sprintf("  Pad Length: %d", padding.PadLength),
+		fmt.Sprintf("  Payload Length: %d", padding.PayloadLength),
+		fmt.Sprintf("  Non-Zero Padding: %s", nonZero),
+	}
+}
+
+func streamWindowLines(windows *StreamWindows) []string {
+	if windows == nil {
+		return nil
+	}
+
+	return []string{
+		"Stream Windows:",
+		fmt.Sprintf("  Client: %d (Connection: %d)", windows.Client.Stream.current, windows.Client.Connection.current),
+		fmt.Sprintf("  Server: %d (Connection: %d)", windows.Server.Stream.current, windows.Server.Connection.current),
+	}
+}
+
+func bodyInfoLines(body *BodyInfo) []string {
+	lines := []string{
+		"Body:",
+		fmt.Sprintf("  Encoding: %s", body.Encoding),
+		fmt.Sprintf("  Size: %d (Decoded: %d)", body.Size, body.DecodedSize),
+	}
+	if body.Error != "" {
+		lines = append(lines, fmt.Sprintf("  Error: %s", body.Error))
+	}
+	if body.Preview != "" {
+		lines = append(lines, fmt.Sprintf("  Preview: %q", body.Preview))
+	}
+
+	return lines
+}
+
+// headersEnded reports whether a frame ends a header block.
+func headersEnded(frame http2.Frame) bool {
+	switch frame := frame.(type) {
+	case *http2.HeadersFrame:
+		return frame.HeadersEnded()
+	case *http2.PushPromiseFrame:
+		return frame.HeadersEnded()
+	case *http2.ContinuationFrame:
+		return frame.HeadersEnded()
+	}
+
+	return false
+}
+
+func headerBlockLines(block FrameHeaderFields) []string {
+	lines := []string{}
+
+	if len(block.Fragments) > 1 {
+		sizes := make([]string, len(block.Fragments))
+		for i, size := range block.Fragments {
+			sizes[i] = fmt.Sprintf("%d", size)
+		}
+		lines = append(lines, fmt.Sprintf("Header Block: %d fragments (%s bytes)", len(block.Fragments), strings.Join(sizes, ", ")))
+	}
+
+	if len(block.HeaderFields) > 0 {
+		lines = append(lines, "Header Fields:")
+		lines = append(lines, headerFieldLines(block.HeaderFields)...)
+	}
+
+	return lines
+}
+
+func headerFieldLines(fields HeaderFields) []string {
+	lines := make([]string, 0, len(fields))
+
+	for _, hf := range fields {
+		encoding := []string{}
+		if hf.Representation != "" {
+			encoding = append(encoding, hf.Representation)
+		}
+		if hf.Index > 0 {
+			encoding = append(encoding, fmt.Sprintf("index %d", hf.Index))
+		}
+		if hf.NameHuffman {
+			encoding = append(encoding, "huffman name")
+		}
+		if hf.ValueHuffman {
+			encoding = append(encoding, "huffman value")
+		}
+		if hf.Size == 1 {
+			encoding = append(encoding, "1 byte")
+		} else if hf.Size > 1 {
+			encoding = append(encoding, fmt.Sprintf("%d bytes", hf.Size))
+		}
+
+		line := fmt.Sprintf("  %s: %s", hf.Name, hf.Value)
+		if len(encoding) > 0 {
+			line += color("gray", fmt.Sprintf(" [%s]", strings.Join(encoding, ", ")))
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+func (fd *FrameDumper) PrintProblem(e *Event) {
+	p := e.Problem
+	fe := e.FrameError
+
+	label := color("red", "ERROR")
+	if p != nil && p.Severity == SeverityWarning {
+		label = color("yellow", "WARNING")
+	}
+
+	data := []string{}
+
+	var msg string
+	if fe != nil {
+		msg = fmt.Sprintf("%s %s", label, fe.Message)
+		data = append(data, fmt.Sprintf("Offset: %d", fe.Offset))
+		if fe.Length > 0 {
+			data = append(data, fmt.Sprintf("Skipped: %d bytes", fe.Length))
+		}
+	} else {
+		msg = fmt.Sprintf("%s %s", label, p.Message)
+	}
+	if p != nil && p.Rule != "" {
+		data = append(data, fmt.Sprintf("Rule: %s (%s)", p.Rule, p.Section))
+	}
+
+	fd.PrintMessage(e.StreamID, msg, data, e.Remote)
+}
+
+func (fd *FrameDumper) PrintHTTP1Message(e *Event) {
+	m := e.HTTP1
+
+	var msgColor string
+	if e.Remote {
+		msgColor = "cyan"
+	} else {
+		msgColor = "magenta"
+	}
+
+	data := []string{}
+
+	if e.Type == EventHTTP1Body {
+		msg := fmt.Sprintf("%s <Length:%d>", color(msgColor, m.Version+" Body"), m.BodySize)
+		if m.Framing == HTTP1FramingChunked {
+			data = append(data, fmt.Sprintf("Chunks: %d", m.Chunks))
+		}
+		if len(m.Trailers) > 0 {
+			data = append(data, "Trailers:")
+			data = append(data, headerFieldLines(m.Trailers)...)
+		}
+		if e.Body != nil {
+			data = append(data, bodyInfoLines(e.Body)...)
+		}
+
+		fd.PrintMessage(e.StreamID, msg, data, e.Remote)
+		return
+	}
+
+	var msg string
+	if m.Request() {
+		msg = fmt.Sprintf("%s %s %s", color(msgColor, m.Version+" Request"), m.Method, m.Target)
+	} else {
+		msg = fmt.Sprintf("%s %d %s", color(msgColor, m.Version+" Response"), m.Status, m.Reason)
+	}
+
+	if len(m.Headers) > 0 {
+		data = append(data, "Header Fields:")
+		data = append(data, headerFieldLines(m.Headers)...)
+	}
+
+	switch m.Framing {
+	case HTTP1FramingContentLength:
+		data = append(data, fmt.Sprintf("Framing: content-length (%d bytes)", m.ContentLength))
+	case HTTP1FramingChunked:
+		data = append(data, "Framing: chunked")
+	case HTTP1FramingClose:
+		data = append(data, "Framing: until close")
+	}
+
+	keepAlive := "No"
+	if m.KeepAlive {
+		keepAlive = "Yes"
+	}
+	data = append(data, fmt.Sprintf("Keep-Alive: %s", keepAlive))
+
+	fd.PrintMessage(e.StreamID, msg, data, e.Remote)
+}
+
+func (fd *FrameDumper) PrintStall(e *Event) {
+	stall := e.Stall
+
+	msg := fmt.Sprintf("%s %s %s window", color("yellow", "Flow Control Stalled:"), stall.Sender, stall.Window)
+	if e.Type == EventFlowResume {
+		msg = fmt.Sprintf("%s %s %s window", color("green", "Flow Control Resumed:"), stall.Sender, stall.Window)
+	}
+
+	data := []string{
+		fmt.Sprintf("Window Size: %d", stall.WindowSize),
+	}
+	if e.Type == EventFlowResume {
+		data = append(data, fmt.Sprintf("Stalled: %s", time.Duration(stall.Duration)))
+	}
+	if stall.PendingBytes > 0 {
+		data = append(data, fmt.Sprintf("Pending: %d bytes", stall.PendingBytes))
+	}
+
+	fd.PrintMessage(e.StreamID, msg, data, e.Remote)
+}
+
+func (fd *FrameDumper) PrintClose(e *Event) {
+	data := []string{}
+	if len(e.OpenStreams) > 0 {
+		data = append(data, "Open Streams:")
+		for _, s := range e.OpenStreams {
+			data = append(data, fmt.Sprintf("  %d: Client %s, Server %s", s.StreamID, s.Client, s.Server))
+		}
+	}
+	if len(e.StallTimes) > 0 {
+		data = append(data, "Flow Control Stalls:")
+		for _, s := range e.StallTimes {
+			stream := fmt.Sprintf("%d", s.StreamID)
+			if s.StreamID == 0 {
+				stream = "Connection"
+			}
+			data = append(data, fmt.Sprintf("  %s: Client %s, Server %s", stream, time.Duration(s.Client), time.Duration(s.Server)))
+		}
+	}
+	if e.PriorityTree != nil {
+		data = append(data, "Priority Tree:")
+		data = append(data, priorityTreeLines(e.PriorityTree)...)
+	}
+
+	fd.PrintMessage(e.StreamID, e.Message, data, e.Remote)
+}
+
 func (fd *FrameDumper) PrintConnectionState(e *Event) {
 	msg := fmt.Sprintf("Negotiated Protocol: %s", e.State.NegotiatedProtocol)
 	fd.PrintMessage(e.StreamID, msg, nil, e.Remote)
 }
 
+func (fd *FrameDumper) PrintGRPCMessage(e *Event) {
+	gm := e.GRPCMessage
+
+	var msgColor string
+	if e.Remote {
+		msgColor = "cyan"
+	} else {
+		msgColor = "magenta"
+	}
+
+	var compressed string
+	if gm.Compressed {
+		compressed = "Yes"
+	} else {
+		compressed = "No"
+	}
+
+	msg := fmt.Sprintf("%s <Length:%d>", color(msgColor, "gRPC Message"), gm.Length)
+	data := []string{
+		fmt.Sprintf("Compressed: %s", compressed),
+		fmt.Sprintf("Frames: %d", gm.Frames),
+	}
+	if gm.Type != "" {
+		data = append(data, fmt.Sprintf("Type: %s", gm.Type))
+	}
+	if gm.Error != "" {
+		data = append(data, fmt.Sprintf("Error: %s", gm.Error))
+	}
+	if len(gm.Payload) > 0 {
+		data = append(data, fmt.Sprintf("Payload: %s", gm.Payload))
+	}
+	if len(gm.Fields) > 0 {
+		data = append(data, "Fields:")
+		data = append(data, wireFieldLines(gm.Fields, "  ")...)
+	}
+
+	fd.PrintMessage(e.StreamID, msg, data, e.Remote)
+}
+
+func (fd *FrameDumper) PrintGRPCStatus(e *Event) {
+	gs := e.GRPCStatus
+
+	msg := fmt.Sprintf("%s %s (%d)", color("magenta", "gRPC Status"), gs.Name, gs.Code)
+	data := []string{}
+	if gs.Message != "" {
+		data = append(data, fmt.Sprintf("Message: %s", gs.Message))
+	}
+
+	fd.PrintMessage(e.StreamID, msg, data, e.Remote)
+}
+
 func (fd *FrameDumper) PrintMessage(streamID uint32, msg string, data []string, remote bool) {
 	var buffer bytes.Buffer
 	var flowStr string
@@ -537,29 +1411,77 @@ func (fd *FrameDumper) PrintMessage(streamID uint32, msg string, data []string,
 	fmt.Print(buffer.String())
 }
 
-func NewFrameDumper(addr net.Addr, formatter Formatter) *FrameDumper {
+func NewConnectionID(addr net.Addr) string {
 	now := time.Now().UnixNano()
 
 	id := fmt.Sprintf("%d:%s", now, addr.String())
-	idHex := fmt.Sprintf("%x", md5.Sum([]byte(id)))
+	return fmt.Sprintf("%x", md5.Sum([]byte(id)))
+}
 
+func NewFrameDumper(id string, addr net.Addr, config DumpConfig) *FrameDumper {
 	dumper := &FrameDumper{
-		ID:         idHex,
+		ID:         id,
 		RemoteAddr: addr,
-		Formatter:  formatter,
+		Formatter:  config.Formatter,
+		HPACK:      config.HPACK,
+
+		Clock: func() int64 {
+			return time.Now().UnixNano()
+		},
 
 		start: 0,
 
 		remoteFramer: NewFramer(true),
 		originFramer: NewFramer(false),
 
-		remoteFlowController: NewFlowController(),
-		originFlowController: NewFlowController(),
+		remoteFlowController: NewFlowController("server"),
+		originFlowController: NewFlowController("client"),
+
+		streams:   NewStreamTracker(),
+		urgencies: NewExtensiblePriorities(),
+		linter:    NewLinter(config.LintDisabled),
 
 		indent: strings.Repeat(" ", 28),
 	}
 
-	dumper.Connect()
+	if config.Priority {
+		dumper.priorities = NewPriorityTree()
+	}
+
+	if config.HAR != nil || config.Bodies != nil || config.Decode || config.GRPC {
+		dumper.exchanges = NewExchangeTracker(id)
+		dumper.exchanges.Decode = config.Decode
+		dumper.exchanges.GRPC = config.GRPC
+		dumper.exchanges.Protos = config.Protos
+
+		if config.HAR != nil {
+			dumper.exchanges.CaptureBody = config.HAR.Body
+			dumper.exchanges.Handlers = append(dumper.exchanges.Handlers, config.HAR.Add)
+		}
+
+		if config.Bodies != nil {
+			// The bodies are captured once for both, so --body-max also
+			// applies to the bodies in the HAR file.
+			dumper.exchanges.MaxBodySize = config.Bodies.MaxSize
+			dumper.exchanges.CaptureBody = true
+			dumper.exchanges.Handlers = append(dumper.exchanges.Handlers, config.Bodies.Add)
+		}
+	}
 
 	return dumper
 }
+
+// isHTTP1Request reports whether data starts like a request line, with a
+// method in uppercase letters.
+func isHTTP1Request(data []byte) bool {
+	for i, b := range data {
+		if b == ' ' {
+			return i > 0
+		}
+		if (b < 'A' || b > 'Z') && b != '-' {
+			return false
+		}
+	}
+
+	return len(data) > 0
+}
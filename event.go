@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"net"
-	"time"
 
 	"golang.org/x/net/http2"
 )
@@ -13,24 +12,44 @@ const (
 	EventClose           = "close"
 	EventConnectionState = "connection_state"
 	EventFrame           = "frame"
+	EventWarning         = "warning"
+	EventError           = "error"
+	EventGRPCMessage     = "grpc_message"
+	EventGRPCStatus      = "grpc_status"
+	EventFlowStall       = "flow_stall"
+	EventFlowResume      = "flow_resume"
+	EventHTTP1Message    = "http1_message"
+	EventHTTP1Body       = "http1_body"
 )
 
 type Event struct {
-	Time         int64  `json:"time"`
-	Duration     int64  `json:"duration"`
-	Remote       bool   `json:"remote"`
-	RemoteAddr   net.IP `json:"remote_addr"`
-	RemotePort   int    `json:"remote_port"`
-	ConnectionID string `json:"connection_id"`
-	StreamID     uint32 `json:"stream_id"`
-	Type         string `json:"type"`
-	Message      string `json:"-"`
-	State        *State `json:"state,omitempty"`
-	Frame        *Frame `json:"frame,omitempty"`
-}
-
-func NewEvent(eventType string, remote bool, addr net.Addr, connID string, streamID uint32, start int64) *Event {
-	now := time.Now().UnixNano()
+	Time         int64            `json:"time"`
+	Duration     int64            `json:"duration"`
+	Remote       bool             `json:"remote"`
+	RemoteAddr   net.IP           `json:"remote_addr"`
+	RemotePort   int              `json:"remote_port"`
+	ConnectionID string           `json:"connection_id"`
+	StreamID     uint32           `json:"stream_id"`
+	Type         string           `json:"type"`
+	Message      string           `json:"-"`
+	State        *State           `json:"state,omitempty"`
+	Frame        *Frame           `json:"frame,omitempty"`
+	Stream       *StreamState     `json:"stream,omitempty"`
+	Problem      *Problem         `json:"problem,omitempty"`
+	FrameError   *FrameError      `json:"frame_error,omitempty"`
+	OpenStreams  []StreamSummary  `json:"open_streams,omitempty"`
+	Stall        *FlowStall       `json:"stall,omitempty"`
+	StallTimes   []StallSummary   `json:"stall_times,omitempty"`
+	PriorityTree *PriorityNode    `json:"priority_tree,omitempty"`
+	Priority     *StreamPriority  `json:"priority,omitempty"`
+	Body         *BodyInfo        `json:"body,omitempty"`
+	HPACK        *HPACKTableState `json:"hpack,omitempty"`
+	GRPCMessage  *GRPCMessage     `json:"grpc_message,omitempty"`
+	GRPCStatus   *GRPCStatus      `json:"grpc_status,omitempty"`
+	HTTP1        *HTTP1Message    `json:"http1,omitempty"`
+}
+
+func NewEvent(eventType string, remote bool, addr net.Addr, connID string, streamID uint32, now int64, start int64) *Event {
 	dur := int64(0)
 
 	if start > 0 {
@@ -50,6 +69,20 @@ func NewEvent(eventType string, remote bool, addr net.Addr, connID string, strea
 	}
 }
 
+// Derive returns an event of another type that happened along with e.
+func (e *Event) Derive(eventType string) *Event {
+	return &Event{
+		Time:         e.Time,
+		Duration:     e.Duration,
+		Type:         eventType,
+		Remote:       e.Remote,
+		RemoteAddr:   e.RemoteAddr,
+		RemotePort:   e.RemotePort,
+		ConnectionID: e.ConnectionID,
+		StreamID:     e.StreamID,
+	}
+}
+
 type State struct {
 	NegotiatedProtocol string `json:"negotiated_protocol"`
 }
@@ -76,10 +109,12 @@ func NewFrame() *Frame {
 type FramePayload interface{}
 
 type DataFramePayload struct {
+	FramePaddingGroup
 	FrameWindowSizeGroup
 }
 
 type HeadersFramePayload struct {
+	FramePaddingGroup
 	FramePriority
 	FrameHeaderFields
 }
@@ -98,6 +133,7 @@ type SettingsFramePayload struct {
 
 type PushPromiseFramePayload struct {
 	PromisedStreamID uint32 `json:"promised_stream_id"`
+	FramePaddingGroup
 	FrameHeaderFields
 }
 
@@ -120,6 +156,30 @@ type ContinuationFramePayload struct {
 	FrameHeaderFields
 }
 
+type AltSvcFramePayload struct {
+	Origin     string `json:"origin,omitempty"`
+	FieldValue string `json:"field_value"`
+}
+
+type OriginFramePayload struct {
+	Origins []string `json:"origins"`
+}
+
+// UnknownFramePayload is the raw content of a frame of a type that is not
+// decoded.
+type UnknownFramePayload struct {
+	Type    uint8  `json:"type"`
+	Flags   uint8  `json:"flags"`
+	Payload string `json:"payload"`
+}
+
+type PriorityUpdateFramePayload struct {
+	PrioritizedStreamID uint32 `json:"prioritized_stream_id"`
+	PriorityFieldValue  string `json:"priority_field_value"`
+	Urgency             int    `json:"urgency"`
+	Incremental         bool   `json:"incremental"`
+}
+
 type FrameNameID struct {
 	Name string
 	ID   uint8
@@ -133,8 +193,60 @@ func (fni FrameNameID) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("\"%s\"", fni.Name)), nil
 }
 
+// FrameHeaderFields is set on the frame that ends a header block, with the
+// fields of the whole block and the sizes of its fragments.
 type FrameHeaderFields struct {
-	HeaderFields map[string]string `json:"header_fields,omitempty"`
+	HeaderFields HeaderFields `json:"header_fields,omitempty"`
+	Fragments    []int        `json:"fragments,omitempty"`
+}
+
+// HeaderField is a decoded header field and the way it was encoded in the
+// header block.
+type HeaderField struct {
+	Name           string `json:"name"`
+	Value          string `json:"value"`
+	Representation string `json:"representation,omitempty"`
+	Index          uint64 `json:"index,omitempty"`
+	NameHuffman    bool   `json:"name_huffman,omitempty"`
+	ValueHuffman   bool   `json:"value_huffman,omitempty"`
+	Size           int    `json:"size,omitempty"`
+}
+
+// HeaderFields is a list of header fields in the order of the header block.
+type HeaderFields []HeaderField
+
+// Get returns the value of the first field with the given name.
+func (hfs HeaderFields) Get(name string) string {
+	for _, hf := range hfs {
+		if hf.Name == name {
+			return hf.Value
+		}
+	}
+
+	return ""
+}
+
+// Has reports whether a field with the given name exists.
+func (hfs HeaderFields) Has(name string) bool {
+	for _, hf := range hfs {
+		if hf.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Values returns the values of all fields with the given name.
+func (hfs HeaderFields) Values(name string) []string {
+	values := []string{}
+	for _, hf := range hfs {
+		if hf.Name == name {
+			values = append(values, hf.Value)
+		}
+	}
+
+	return values
 }
 
 type FramePriority struct {
@@ -158,8 +270,28 @@ type FrameErrorCode struct {
 	ErrorCode http2.ErrCode `json:"error_code"`
 }
 
+type FramePaddingGroup struct {
+	Padding *FramePadding `json:"padding,omitempty"`
+}
+
+// FramePadding is the padding of a padded frame. PayloadLength is the length
+// of the frame without the Pad Length field and the padding.
+type FramePadding struct {
+	PadLength     uint8  `json:"pad_length"`
+	PayloadLength uint32 `json:"payload_length"`
+	NonZero       bool   `json:"non_zero"`
+}
+
 type FrameWindowSizeGroup struct {
-	WindowSize FrameWindowSize `json:"window_size"`
+	WindowSize    FrameWindowSize `json:"window_size"`
+	StreamWindows *StreamWindows  `json:"stream_windows,omitempty"`
+}
+
+// StreamWindows are the windows that limit the DATA sent on a stream by the
+// client and by the server.
+type StreamWindows struct {
+	Client FrameWindowSize `json:"client"`
+	Server FrameWindowSize `json:"server"`
 }
 
 type FrameWindowSize struct {
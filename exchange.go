@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// Message is one side of an exchange rebuilt from the frames of a stream.
+type Message struct {
+	Start    int64
+	End      int64
+	Headers  HeaderFields
+	Trailers HeaderFields
+	Body     []byte
+	BodySize int
+	Ended    bool
+
+	// StreamEnded is set by a HEADERS frame with END_STREAM. The message
+	// ends once the header block of the frame is complete.
+	StreamEnded bool
+
+	// Decoder is set when the body is decoded by its content-encoding.
+	Decoder *BodyDecoder
+
+	// GRPC is set when the body is split into gRPC messages.
+	GRPC *GRPCParser
+}
+
+func (m *Message) headerBlock() *HeaderFields {
+	if m.Headers == nil || strings.HasPrefix(m.Headers.Get(":status"), "1") {
+		m.Headers = HeaderFields{}
+		return &m.Headers
+	}
+
+	m.Trailers = HeaderFields{}
+	return &m.Trailers
+}
+
+// Exchange is a request and its response carried by a single stream, or by
+// an HTTP/1.x connection in turn.
+type Exchange struct {
+	ConnectionID string
+	StreamID     uint32
+	HTTPVersion  string
+	Request      *Message
+	Response     *Message
+	Reset        bool
+}
+
+// ExchangeTracker rebuilds exchanges from the decoded frames of a connection
+// and passes each of them to the handlers once it is complete.
+type ExchangeTracker struct {
+	ConnectionID string
+	CaptureBody  bool
+	MaxBodySize  int
+	Decode       bool
+	GRPC         bool
+	Protos       *ProtoRegistry
+	Handlers     []func(*Exchange)
+
+	exchanges map[uint32]*Exchange
+
+	// reset holds the streams whose exchange was passed on by RST_STREAM.
+	reset map[uint32]bool
+
+	// Header blocks continued by CONTINUATION frames, per sender.
+	remoteBlock *HeaderFields
+	originBlock *HeaderFields
+}
+
+// HandleFrame adds a frame to its exchange and returns the events derived
+// from it, such as the gRPC messages that the frame completes.
+func (et *ExchangeTracker) HandleFrame(e *Event, frame http2.Frame) []*Event {
+	streamID := frame.Header().StreamID
+	events := []*Event{}
+
+	// Frames that were in flight when the stream was reset must not start
+	// another exchange. CONTINUATION frames only continue a header block that
+	// is in progress, such as the one of a PUSH_PROMISE.
+	if et.reset[streamID] {
+		switch frame.(type) {
+		case *http2.HeadersFrame, *http2.DataFrame, *http2.RSTStreamFrame:
+			return events
+		}
+	}
+
+	switch frame := frame.(type) {
+	case *http2.HeadersFrame:
+		p := e.Frame.Payload.(HeadersFramePayload)
+		m := et.message(streamID, e.Remote, e.Time)
+		block := m.headerBlock()
+		et.addHeaderFields(block, p.HeaderFields, e.Remote, frame.HeadersEnded())
+		if frame.StreamEnded() {
+			m.StreamEnded = true
+		}
+		if frame.HeadersEnded() {
+			events = append(events, et.grpcStatus(e, *block)...)
+			if m.StreamEnded {
+				et.endMessage(streamID, m, e)
+			}
+		}
+
+	case *http2.PushPromiseFrame:
+		p := e.Frame.Payload.(PushPromiseFramePayload)
+		ex := et.exchange(frame.PromiseID)
+		ex.Request = &Message{Start: e.Time, End: e.Time, Ended: true}
+		block := ex.Request.headerBlock()
+		et.addHeaderFields(block, p.HeaderFields, e.Remote, frame.HeadersEnded())
+
+	case *http2.ContinuationFrame:
+		p := e.Frame.Payload.(ContinuationFramePayload)
+		block := et.originBlock
+		if e.Remote {
+			block = et.remoteBlock
+		}
+		if block != nil {
+			et.addHeaderFields(block, p.HeaderFields, e.Remote, frame.HeadersEnded())
+			if frame.HeadersEnded() {
+				events = append(events, et.grpcStatus(e, *block)...)
+				et.endHeaders(streamID, e)
+			}
+		}
+
+	case *http2.DataFrame:
+		m := et.message(streamID, e.Remote, e.Time)
+		events = append(events, et.addData(streamID, m, frame.Data(), e)...)
+		if frame.StreamEnded() {
+			et.endMessage(streamID, m, e)
+		}
+
+	case *http2.RSTStreamFrame:
+		et.reset[streamID] = true
+		ex, ok := et.exchanges[streamID]
+		if ok {
+			ex.Reset = true
+			et.finish(ex)
+		}
+	}
+
+	return events
+}
+
+// HandleMessageHeaders adds the header section of an HTTP/1.x message, given
+// as HTTP/2 header fields, to the exchange of the stream of e.
+func (et *ExchangeTracker) HandleMessageHeaders(e *Event, version string, fields HeaderFields) {
+	// The exchange takes the version of the request.
+	if e.Remote {
+		et.exchange(e.StreamID).HTTPVersion = version
+	}
+
+	m := et.message(e.StreamID, e.Remote, e.Time)
+	*m.headerBlock() = fields
+}
+
+// HandleMessageData adds a piece of the body of an HTTP/1.x message and
+// returns the events derived from it.
+func (et *ExchangeTracker) HandleMessageData(e *Event, data []byte) []*Event {
+	m := et.message(e.StreamID, e.Remote, e.Time)
+	return et.addData(e.StreamID, m, data, e)
+}
+
+// HandleMessageEnd ends an HTTP/1.x message with its trailers.
+func (et *ExchangeTracker) HandleMessageEnd(e *Event, trailers HeaderFields) {
+	m := et.message(e.StreamID, e.Remote, e.Time)
+	if len(trailers) > 0 {
+		m.Trailers = trailers
+	}
+	et.endMessage(e.StreamID, m, e)
+}
+
+// Close passes the exchanges that never completed to the handlers.
+func (et *ExchangeTracker) Close() {
+	for _, ex := range et.exchanges {
+		et.finish(ex)
+	}
+}
+
+// endHeaders ends the message of a stream whose header block, completed by a
+// CONTINUATION frame, was started by a HEADERS frame with END_STREAM.
+func (et *ExchangeTracker) endHeaders(streamID uint32, e *Event) {
+	ex, ok := et.exchanges[streamID]
+	if !ok {
+		return
+	}
+
+	m := ex.Response
+	if e.Remote {
+		m = ex.Request
+	}
+	if m != nil && m.StreamEnded && !m.Ended {
+		et.endMessage(streamID, m, e)
+	}
+}
+
+func (et *ExchangeTracker) exchange(streamID uint32) *Exchange {
+	ex, ok := et.exchanges[streamID]
+	if !ok {
+		ex = &Exchange{
+			ConnectionID: et.ConnectionID,
+			StreamID:     streamID,
+			HTTPVersion:  "HTTP/2.0",
+		}
+		et.exchanges[streamID] = ex
+	}
+
+	return ex
+}
+
+func (et *ExchangeTracker) message(streamID uint32, remote bool, t int64) *Message {
+	ex := et.exchange(streamID)
+
+	m := ex.Response
+	if remote {
+		m = ex.Request
+	}
+	if m == nil {
+		m = &Message{Start: t}
+		if remote {
+			ex.Request = m
+		} else {
+			ex.Response = m
+		}
+	}
+
+	return m
+}
+
+// addData adds a piece of the body of a message and returns the events
+// derived from it.
+func (et *ExchangeTracker) addData(streamID uint32, m *Message, data []byte, e *Event) []*Event {
+	events := []*Event{}
+
+	m.BodySize += len(data)
+	if et.Decode {
+		if m.Decoder == nil {
+			keep := bodyPreviewSize
+			if et.CaptureBody {
+				keep = et.MaxBodySize
+			}
+			m.Decoder = NewBodyDecoder(m.Headers.Get("content-encoding"), keep)
+		}
+		if m.Decoder != nil {
+			m.Decoder.Write(data)
+		}
+	}
+	if et.GRPC {
+		if m.GRPC == nil && isGRPC(m.Headers) {
+			m.GRPC = &GRPCParser{MaxSize: grpcMaxMessageSize}
+			if et.MaxBodySize > 0 {
+				m.GRPC.MaxSize = et.MaxBodySize
+			}
+		}
+		if m.GRPC != nil {
+			ex := et.exchanges[streamID]
+			path := ""
+			if ex.Request != nil {
+				path = ex.Request.Headers.Get(":path")
+			}
+			for _, msg := range m.GRPC.Write(data) {
+				if msg.Skipped {
+					we := e.Derive(EventWarning)
+					we.Problem = &Problem{
+						Severity: SeverityWarning,
+						Message:  fmt.Sprintf("gRPC message of %d bytes exceeds the limit of %d bytes and is skipped", msg.Length, m.GRPC.MaxSize),
+					}
+					events = append(events, we)
+					continue
+				}
+				decodeGRPCMessage(et.Protos, path, e.Remote, m.Headers.Get("grpc-encoding"), msg)
+				ge := e.Derive(EventGRPCMessage)
+				ge.GRPCMessage = msg
+				events = append(events, ge)
+			}
+		}
+	}
+	if et.CaptureBody {
+		if et.MaxBodySize > 0 && len(m.Body)+len(data) > et.MaxBodySize {
+			data = data[:et.MaxBodySize-len(m.Body)]
+		}
+		m.Body = append(m.Body, data...)
+	}
+
+	return events
+}
+
+func (et *ExchangeTracker) addHeaderFields(block *HeaderFields, fields HeaderFields, remote bool, ended bool) {
+	*block = append(*block, fields...)
+
+	if ended {
+		block = nil
+	}
+	if remote {
+		et.remoteBlock = block
+	} else {
+		et.originBlock = block
+	}
+}
+
+// grpcStatus returns a status event if a completed header block sent by the
+// origin carries grpc-status, as trailers or as a trailers-only response.
+func (et *ExchangeTracker) grpcStatus(e *Event, block HeaderFields) []*Event {
+	if !et.GRPC || e.Remote {
+		return nil
+	}
+
+	status := NewGRPCStatus(block)
+	if status == nil {
+		return nil
+	}
+
+	ge := e.Derive(EventGRPCStatus)
+	ge.GRPCStatus = status
+
+	return []*Event{ge}
+}
+
+func (et *ExchangeTracker) endMessage(streamID uint32, m *Message, e *Event) {
+	m.End = e.Time
+	m.Ended = true
+
+	if m.Decoder != nil {
+		m.Decoder.Close()
+		e.Body = m.Decoder.Info()
+	}
+
+	ex := et.exchanges[streamID]
+	if ex.Request != nil && ex.Request.Ended && ex.Response != nil && ex.Response.Ended {
+		et.finish(ex)
+	}
+}
+
+func (et *ExchangeTracker) finish(ex *Exchange) {
+	delete(et.exchanges, ex.StreamID)
+
+	for _, m := range []*Message{ex.Request, ex.Response} {
+		if m != nil && m.Decoder != nil {
+			m.Decoder.Close()
+		}
+	}
+
+	for _, h := range et.Handlers {
+		h(ex)
+	}
+}
+
+func NewExchangeTracker(connID string) *ExchangeTracker {
+	return &ExchangeTracker{
+		ConnectionID: connID,
+		Handlers:     []func(*Exchange){},
+		exchanges:    map[uint32]*Exchange{},
+		reset:        map[uint32]bool{},
+	}
+}
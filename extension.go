@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errShortExtensionFrame = errors.New("frame payload too short")
+
+// parseAltSvcFrame decodes the payload of an ALTSVC frame (RFC 7838,
+// Section 4).
+func parseAltSvcFrame(payload []byte) (AltSvcFramePayload, error) {
+	p := AltSvcFramePayload{}
+	if len(payload) < 2 {
+		return p, errShortExtensionFrame
+	}
+
+	originLen := int(binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+	if len(payload) < originLen {
+		return p, errShortExtensionFrame
+	}
+
+	p.Origin = string(payload[:originLen])
+	p.FieldValue = string(payload[originLen:])
+
+	return p, nil
+}
+
+// parseOriginFrame decodes the payload of an ORIGIN frame (RFC 8336,
+// Section 2).
+func parseOriginFrame(payload []byte) (OriginFramePayload, error) {
+	p := OriginFramePayload{
+		Origins: []string{},
+	}
+
+	for len(payload) > 0 {
+		if len(payload) < 2 {
+			return p, errShortExtensionFrame
+		}
+
+		originLen := int(binary.BigEndian.Uint16(payload))
+		payload = payload[2:]
+		if len(payload) < originLen {
+			return p, errShortExtensionFrame
+		}
+
+		p.Origins = append(p.Origins, string(payload[:originLen]))
+		payload = payload[originLen:]
+	}
+
+	return p, nil
+}
@@ -2,63 +2,300 @@ package main
 
 import (
 	"fmt"
+	"sort"
 )
 
+// maxWindowSize is the largest flow-control window (RFC 9113, Section 6.9.1).
+const maxWindowSize = 1<<31 - 1
+
 type WindowSize struct {
-	current uint32
-	delta   int32
+	current int64
+	delta   int64
 }
 
 func (ws WindowSize) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("%d", ws.current)), nil
 }
 
-type FlowController struct {
-	InitialWindowSize    uint32
-	ConnectionWindowSize uint32
-	StreamWindowSize     map[uint32]uint32
+// Overrun reports whether a decrease took more than was left in the window.
+func (ws WindowSize) Overrun() bool {
+	return ws.delta < 0 && ws.current < 0
+}
+
+// Overflow reports whether the window exceeds the largest allowed size.
+func (ws WindowSize) Overflow() bool {
+	return ws.current > maxWindowSize
+}
+
+// FlowStall is a window of a sender that reached zero, or that reopened
+// after it did.
+type FlowStall struct {
+	Sender     string `json:"sender"`
+	Window     string `json:"window"`
+	WindowSize int64  `json:"window_size"`
+
+	// Duration is how long the window was stalled, set when it reopens.
+	Duration int64 `json:"duration,omitempty"`
+
+	// PendingBytes is what the sender has left to send on the stream, or on
+	// all of its streams for the connection window, as far as known from
+	// content-length.
+	PendingBytes int64 `json:"pending_bytes,omitempty"`
+
+	streamID uint32
+	resumed  bool
+}
+
+// StallSummary is the total time that the windows of a stream stopped the
+// DATA of each side. Stream 0 is the connection window.
+type StallSummary struct {
+	StreamID uint32 `json:"stream_id"`
+	Client   int64  `json:"client"`
+	Server   int64  `json:"server"`
+}
+
+// flowStream is what the sender is known to have left to send on a stream.
+type flowStream struct {
+	// remaining is the size of the message given by content-length less the
+	// DATA sent, or -1 if the size is unknown.
+	remaining int64
+	ended     bool
 }
 
-func (fc *FlowController) UpdateConnectionWindow(size uint32) WindowSize {
-	original := fc.ConnectionWindowSize
+// FlowController holds the flow-control windows advertised by one side of
+// the connection, which limit the DATA sent by the other side. Windows are
+// signed since a smaller SETTINGS_INITIAL_WINDOW_SIZE can make them
+// negative.
+type FlowController struct {
+	// Sender is the side whose DATA is limited by the windows.
+	Sender string
+
+	InitialWindowSize    int64
+	ConnectionWindowSize int64
+	StreamWindowSize     map[uint32]int64
 
+	streams map[uint32]*flowStream
+
+	// stalls holds when each stalled window reached zero, and stallTimes
+	// the total time each window was stalled, by stream ID with 0 for the
+	// connection window.
+	stalls     map[uint32]int64
+	stallTimes map[uint32]int64
+}
+
+func (fc *FlowController) UpdateConnectionWindow(size int64) WindowSize {
 	fc.ConnectionWindowSize += size
-	if fc.ConnectionWindowSize < 0 {
-		fc.ConnectionWindowSize = 0
-	}
 
 	return WindowSize{
-		fc.ConnectionWindowSize,
-		int32(fc.ConnectionWindowSize - original),
+		current: fc.ConnectionWindowSize,
+		delta:   size,
 	}
 }
 
-func (fc *FlowController) UpdateStreamWindow(streamID uint32, size uint32) WindowSize {
+func (fc *FlowController) UpdateStreamWindow(streamID uint32, size int64) WindowSize {
 	_, ok := fc.StreamWindowSize[streamID]
 	if !ok {
 		fc.StreamWindowSize[streamID] = fc.InitialWindowSize
 	}
 
-	original := fc.StreamWindowSize[streamID]
-
 	fc.StreamWindowSize[streamID] += size
-	if fc.StreamWindowSize[streamID] < 0 {
-		fc.StreamWindowSize[streamID] = 0
-	}
 
 	return WindowSize{
-		fc.StreamWindowSize[streamID],
-		int32(fc.StreamWindowSize[streamID] - original),
+		current: fc.StreamWindowSize[streamID],
+		delta:   size,
+	}
+}
+
+// StreamWindow returns the window of a stream without changing it.
+func (fc *FlowController) StreamWindow(streamID uint32) int64 {
+	size, ok := fc.StreamWindowSize[streamID]
+	if !ok {
+		return fc.InitialWindowSize
+	}
+
+	return size
+}
+
+// SetInitialWindowSize applies a new SETTINGS_INITIAL_WINDOW_SIZE. The
+// windows of all open streams change by the difference to the previous
+// value (RFC 9113, Section 6.9.2). It returns the streams whose windows
+// exceed the largest allowed size as a result.
+func (fc *FlowController) SetInitialWindowSize(size uint32) []uint32 {
+	delta := int64(size) - fc.InitialWindowSize
+	fc.InitialWindowSize = int64(size)
+
+	overflow := []uint32{}
+	for streamID := range fc.StreamWindowSize {
+		fc.StreamWindowSize[streamID] += delta
+		if fc.StreamWindowSize[streamID] > maxWindowSize {
+			overflow = append(overflow, streamID)
+		}
+	}
+	sort.Slice(overflow, func(i, j int) bool {
+		return overflow[i] < overflow[j]
+	})
+
+	return overflow
+}
+
+// SetContentLength records the size of the message that the sender sends on
+// a stream.
+func (fc *FlowController) SetContentLength(streamID uint32, length int64) {
+	fc.stream(streamID).remaining = length
+}
+
+// SendData records the DATA sent on a stream, without its padding.
+func (fc *FlowController) SendData(streamID uint32, size int64) {
+	s := fc.stream(streamID)
+	if s.remaining >= 0 {
+		s.remaining -= size
+		if s.remaining < 0 {
+			s.remaining = 0
+		}
+	}
+}
+
+// EndStream records that the sender ended the stream, after which its
+// window no longer stalls the sender.
+func (fc *FlowController) EndStream(streamID uint32, now int64) {
+	fc.stream(streamID).ended = true
+	fc.endStall(streamID, now)
+}
+
+// Stalls checks the connection window and the windows of the given streams,
+// and returns the windows that reached zero or reopened since the last
+// check.
+func (fc *FlowController) Stalls(now int64, streamIDs ...uint32) []*FlowStall {
+	stalls := []*FlowStall{}
+
+	stall := fc.checkStall(0, fc.ConnectionWindowSize, now)
+	if stall != nil {
+		stalls = append(stalls, stall)
+	}
+
+	for _, streamID := range streamIDs {
+		s, ok := fc.streams[streamID]
+		if ok && s.ended {
+			continue
+		}
+
+		stall := fc.checkStall(streamID, fc.StreamWindow(streamID), now)
+		if stall != nil {
+			stalls = append(stalls, stall)
+		}
+	}
+
+	return stalls
+}
+
+// StreamIDs returns the streams with a window, in order.
+func (fc *FlowController) StreamIDs() []uint32 {
+	ids := make([]uint32, 0, len(fc.StreamWindowSize))
+	for streamID := range fc.StreamWindowSize {
+		ids = append(ids, streamID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
+
+// StallTimes returns the total time each window was stalled, counting the
+// windows that are still stalled until now.
+func (fc *FlowController) StallTimes(now int64) map[uint32]int64 {
+	times := map[uint32]int64{}
+	for streamID, d := range fc.stallTimes {
+		times[streamID] = d
+	}
+	for streamID, since := range fc.stalls {
+		times[streamID] += now - since
+	}
+
+	return times
+}
+
+// CloseStream forgets the window of a closed stream.
+func (fc *FlowController) CloseStream(streamID uint32, now int64) {
+	fc.endStall(streamID, now)
+	delete(fc.StreamWindowSize, streamID)
+	delete(fc.streams, streamID)
+}
+
+func (fc *FlowController) checkStall(streamID uint32, window int64, now int64) *FlowStall {
+	since, stalled := fc.stalls[streamID]
+
+	switch {
+	case !stalled && window <= 0:
+		fc.stalls[streamID] = now
+	case stalled && window > 0:
+		fc.endStall(streamID, now)
+	default:
+		return nil
+	}
+
+	stall := &FlowStall{
+		Sender:       fc.Sender,
+		Window:       "stream",
+		WindowSize:   window,
+		PendingBytes: fc.pending(streamID),
+		streamID:     streamID,
+		resumed:      stalled,
+	}
+	if streamID == 0 {
+		stall.Window = "connection"
+	}
+	if stalled {
+		stall.Duration = now - since
+	}
+
+	return stall
+}
+
+func (fc *FlowController) endStall(streamID uint32, now int64) {
+	since, ok := fc.stalls[streamID]
+	if !ok {
+		return
 	}
+
+	fc.stallTimes[streamID] += now - since
+	delete(fc.stalls, streamID)
+}
+
+// pending returns the bytes known to be left to send on a stream, or on all
+// streams for stream 0.
+func (fc *FlowController) pending(streamID uint32) int64 {
+	pending := int64(0)
+	for id, s := range fc.streams {
+		if (streamID == 0 || id == streamID) && !s.ended && s.remaining > 0 {
+			pending += s.remaining
+		}
+	}
+
+	return pending
+}
+
+func (fc *FlowController) stream(streamID uint32) *flowStream {
+	s, ok := fc.streams[streamID]
+	if !ok {
+		s = &flowStream{remaining: -1}
+		fc.streams[streamID] = s
+	}
+
+	return s
 }
 
-func NewFlowController() *FlowController {
+func NewFlowController(sender string) *FlowController {
 	initSize := 65535
 
 	fc := &FlowController{
-		InitialWindowSize:    uint32(initSize),
-		ConnectionWindowSize: uint32(initSize),
-		StreamWindowSize:     map[uint32]uint32{},
+		Sender:               sender,
+		InitialWindowSize:    int64(initSize),
+		ConnectionWindowSize: int64(initSize),
+		StreamWindowSize:     map[uint32]int64{},
+		streams:              map[uint32]*flowStream{},
+		stalls:               map[uint32]int64{},
+		stallTimes:           map[uint32]int64{},
 	}
 
 	return fc
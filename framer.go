@@ -2,8 +2,8 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
-	"io"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
@@ -11,71 +11,394 @@ import (
 
 const frameHeaderLen = 9
 
+// defaultMaxFrameSize is the initial SETTINGS_MAX_FRAME_SIZE, and
+// maxFrameSize the largest value allowed (RFC 9113, Section 6.5.2).
+const (
+	defaultMaxFrameSize = 16384
+	maxFrameSize        = 1<<24 - 1
+)
+
+// FrameSizeError is a frame larger than the SETTINGS_MAX_FRAME_SIZE of its
+// receiver.
+type FrameSizeError struct {
+	Header       http2.FrameHeader
+	MaxFrameSize uint32
+}
+
+func (e *FrameSizeError) Error() string {
+	return fmt.Sprintf("%s frame of %d bytes exceeds SETTINGS_MAX_FRAME_SIZE %d", frameTypeName(e.Header.Type), e.Header.Length, e.MaxFrameSize)
+}
+
+// FrameError is a part of the byte stream of one side that could not be read
+// as a frame and was skipped, or as an HTTP/1.x message. Offset counts the
+// bytes sent by that side from the start of the connection, including the
+// connection preface.
+type FrameError struct {
+	Offset  int64  `json:"offset"`
+	Length  int64  `json:"length"`
+	Message string `json:"message"`
+
+	// Header is the header of the frame, or nil for the connection preface.
+	Header *http2.FrameHeader `json:"-"`
+	Err    error              `json:"-"`
+}
+
+func (e *FrameError) Error() string {
+	return e.Message
+}
+
 type Framer struct {
-	writeBuf   *bytes.Buffer
-	readBuf    *bytes.Buffer
-	chunkBuf   []byte
-	framer     *http2.Framer
-	decoder    *hpack.Decoder
-	hfCallback func(hpack.HeaderField)
-	preface    bool
+	writeBuf *bytes.Buffer
+	readBuf  *bytes.Buffer
+	framer   *http2.Framer
+	decoder  *hpack.Decoder
+	table    *HPACKTable
+	fields   HeaderFields
+	preface  bool
+
+	// maxFrameSize is the SETTINGS_MAX_FRAME_SIZE of the receiver.
+	maxFrameSize uint32
+
+	// buf holds the bytes that do not make a complete frame yet, which start
+	// at offset in the byte stream. skip is what is left to discard of a
+	// frame that is skipped.
+	buf    []byte
+	offset int64
+	skip   int64
+
+	// current is the frame that is being handled.
+	current []byte
+
+	// headerBlock collects the fragments of a header block until the frame
+	// with END_HEADERS arrives. The block starts at headerOffset with the
+	// frame headerStart, and headerOpen is set until it ends.
+	headerBlock     []byte
+	headerFragments []int
+	headerOffset    int64
+	headerStart     http2.FrameHeader
+	headerOpen      bool
+
+	// hpackFailed is set once a header block could not be decoded. The
+	// dynamic table is unknown from then on.
+	hpackFailed bool
 }
 
-func (f *Framer) ReadFrame(chunk []byte, callback func(http2.Frame) error) {
+// ReadFrame adds a chunk of the byte stream, which may end anywhere, and
+// calls callback with each frame that is complete. Frames that cannot be
+// decoded are passed to errCallback and skipped, and reading goes on with
+// the next frame.
+func (f *Framer) ReadFrame(chunk []byte, callback func(http2.Frame) error, errCallback func(*FrameError)) {
+	f.buf = append(f.buf, chunk...)
+
 	if !f.preface {
-		if string(chunk[:24]) == "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n" {
+		n := len(f.buf)
+		if n > len(http2.ClientPreface) {
+			n = len(http2.ClientPreface)
+		}
+
+		switch {
+		case string(f.buf[:n]) != http2.ClientPreface[:n]:
+			// The bytes are read as frames, as far as they can be.
 			f.preface = true
-			chunk = chunk[24:]
+			errCallback(&FrameError{
+				Offset:  f.offset,
+				Message: "invalid connection preface",
+			})
+		case n < len(http2.ClientPreface):
+			return
+		default:
+			f.preface = true
+			f.consume(n)
 		}
 	}
 
-	available := false
-	chunk = append(f.chunkBuf, chunk...)
-
 	for {
-		cLen := len(chunk)
-		if cLen < frameHeaderLen {
-			break
+		if f.skip > 0 {
+			n := f.skip
+			if n > int64(len(f.buf)) {
+				n = int64(len(f.buf))
+			}
+			f.consume(int(n))
+			f.skip -= n
+			if f.skip > 0 {
+				return
+			}
+		}
+
+		if len(f.buf) < frameHeaderLen {
+			return
 		}
 
-		pLen := int(uint32(chunk[0])<<16 | uint32(chunk[1])<<8 | uint32(chunk[2]))
-		pEnd := (frameHeaderLen + pLen)
+		header := http2.FrameHeader{
+			Type:     http2.FrameType(f.buf[3]),
+			Flags:    http2.Flags(f.buf[4]),
+			Length:   uint32(f.buf[0])<<16 | uint32(f.buf[1])<<8 | uint32(f.buf[2]),
+			StreamID: binary.BigEndian.Uint32(f.buf[5:]) & (1<<31 - 1),
+		}
+		offset := f.offset
+		frameLen := int64(frameHeaderLen) + int64(header.Length)
 
-		if cLen < pEnd {
-			break
+		// An oversize frame is skipped as it arrives, without holding it.
+		if header.Length > f.maxFrameSize {
+			err := &FrameSizeError{Header: header, MaxFrameSize: f.maxFrameSize}
+			f.consume(frameHeaderLen)
+			f.skip = int64(header.Length)
+			errCallback(&FrameError{
+				Offset:  offset,
+				Length:  frameLen,
+				Message: err.Error(),
+				Header:  &header,
+				Err:     err,
+			})
+			f.dropHeader(header, errCallback)
+			continue
 		}
 
-		f.readBuf.Write(chunk[:pEnd])
-		chunk = chunk[pEnd:]
-		available = true
+		if int64(len(f.buf)) < frameLen {
+			return
+		}
+
+		f.current = append([]byte{}, f.buf[:frameLen]...)
+		f.consume(int(frameLen))
+
+		// The frame is read on its own, so that a frame that fails leaves
+		// nothing behind for the next one. The order of the frames is
+		// checked here, as the framer does not know about PUSH_PROMISE.
+		var frame http2.Frame
+		var detail error
+		err := f.checkFrameOrder(header)
+		if err == nil {
+			f.readBuf.Reset()
+			f.readBuf.Write(f.current)
+
+			frame, err = f.framer.ReadFrame()
+			if err != nil {
+				detail = f.framer.ErrorDetail()
+			}
+		} else {
+			err, detail = http2.ConnectionError(http2.ErrCodeProtocol), err
+		}
+
+		if err != nil {
+			msg := fmt.Sprintf("%s frame on stream %d could not be decoded: %s", frameTypeName(header.Type), header.StreamID, err)
+			if detail != nil {
+				msg = fmt.Sprintf("%s (%s)", msg, detail)
+			}
+
+			errCallback(&FrameError{
+				Offset:  offset,
+				Length:  frameLen,
+				Message: msg,
+				Header:  &header,
+				Err:     err,
+			})
+			f.dropHeader(header, errCallback)
+			continue
+		}
+
+		switch header.Type {
+		case http2.FrameHeaders, http2.FramePushPromise:
+			f.headerOffset = offset
+			f.headerStart = header
+			f.headerOpen = !header.Flags.Has(http2.FlagHeadersEndHeaders)
+		case http2.FrameContinuation:
+			f.headerOpen = !header.Flags.Has(http2.FlagContinuationEndHeaders)
+		}
+
+		callback(frame)
+	}
+}
+
+// checkFrameOrder returns an error if a frame is not allowed after the frames
+// before it: a header block must be continued by CONTINUATION frames on its
+// stream, and only there (RFC 9113, Section 6.10).
+func (f *Framer) checkFrameOrder(header http2.FrameHeader) error {
+	if f.headerOpen {
+		if header.Type != http2.FrameContinuation || header.StreamID != f.headerStart.StreamID {
+			return fmt.Errorf("got %s for stream %d; expected CONTINUATION following %s for stream %d",
+				frameTypeName(header.Type), header.StreamID, frameTypeName(f.headerStart.Type), f.headerStart.StreamID)
+		}
+		return nil
 	}
 
-	f.chunkBuf = chunk
-	if !available {
+	if header.Type == http2.FrameContinuation {
+		return fmt.Errorf("unexpected CONTINUATION for stream %d", header.StreamID)
+	}
+
+	return nil
+}
+
+// dropHeader gives up on the header block that is open when one of its
+// frames is skipped. The fragment of the frame may have changed the dynamic
+// table, so it is unknown from then on.
+func (f *Framer) dropHeader(header http2.FrameHeader, errCallback func(*FrameError)) {
+	switch header.Type {
+	case http2.FrameHeaders, http2.FramePushPromise, http2.FrameContinuation:
+	default:
 		return
 	}
 
-	for {
-		frame, err := f.framer.ReadFrame()
-		if err != nil {
-			if err != io.EOF {
-				fmt.Printf("Read frame error: %s", err)
-			}
+	f.hpackFailed = true
+	if !f.headerOpen {
+		return
+	}
+
+	start := f.headerStart
+	f.headerOpen = false
+	f.headerBlock, f.headerFragments = nil, nil
+	errCallback(&FrameError{
+		Offset:  f.headerOffset,
+		Message: fmt.Sprintf("header block of %s frame on stream %d abandoned", frameTypeName(start.Type), start.StreamID),
+		Header:  &start,
+	})
+}
+
+// Gap skips the missing bytes of a hole in the byte stream, together with the
+// incomplete frame before them and the skip bytes after them, which do not
+// make a complete frame either. The next chunk must start with a frame.
+func (f *Framer) Gap(missing int64, skip int64) *FrameError {
+	offset := f.offset + int64(len(f.buf))
+	fe := &FrameError{
+		Offset:  f.offset,
+		Length:  int64(len(f.buf)) + missing + skip,
+		Message: fmt.Sprintf("%d bytes missing from the capture at offset %d", missing, offset),
+	}
+
+	f.offset += fe.Length
+	f.buf = nil
+	f.skip = 0
+	f.preface = true
+
+	return fe
+}
+
+// consume drops bytes from the start of buf.
+func (f *Framer) consume(n int) {
+	f.buf = f.buf[n:]
+	f.offset += int64(n)
+}
+
+// ReadHeader adds a header block fragment. The block is decoded when the
+// last fragment arrives, which returns the header fields and the sizes of
+// the fragments. For other fragments it returns nil. A block that cannot be
+// decoded returns the fields decoded so far and an error at the offset of
+// the block.
+func (f *Framer) ReadHeader(fragment []byte, end bool) (HeaderFields, []int, *FrameError) {
+	f.headerBlock = append(f.headerBlock, fragment...)
+	f.headerFragments = append(f.headerFragments, len(fragment))
+	if !end {
+		return nil, nil, nil
+	}
+
+	block, fragments := f.headerBlock, f.headerFragments
+	f.headerBlock, f.headerFragments = nil, nil
+
+	f.fields = HeaderFields{}
+	_, err := f.decoder.Write(block)
+	closeErr := f.decoder.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	fields := f.fields
+	f.fields = nil
+
+	if err != nil {
+		f.hpackFailed = true
+		return fields, fragments, &FrameError{
+			Offset:  f.headerOffset,
+			Message: fmt.Sprintf("header block could not be decoded: %s", err),
+			Err:     err,
+		}
+	}
+	if f.hpackFailed {
+		return fields, fragments, nil
+	}
+
+	// The decoder does not tell how each field was encoded, so the block is
+	// scanned separately and the results are matched in order.
+	encoded, _, _ := scanHeaderBlock(block)
+
+	i := 0
+	for _, hf := range encoded {
+		if hf.SizeUpdate {
+			f.table.SetMaxSize(uint32(hf.Index))
+			continue
+		}
+		if i >= len(fields) {
+			break
+		}
+
+		fields[i].Representation = hf.Representation
+		fields[i].Index = hf.Index
+		fields[i].NameHuffman = hf.NameHuffman
+		fields[i].ValueHuffman = hf.ValueHuffman
+		fields[i].Size = hf.Size
+		if hf.Representation == HeaderIncremental {
+			f.table.Add(fields[i].Name, fields[i].Value)
+		}
+		i++
+	}
+
+	return fields, fragments, nil
+}
+
+// Padding returns the padding of a padded DATA, HEADERS or PUSH_PROMISE
+// frame that is being handled, or nil for other frames.
+func (f *Framer) Padding(frame http2.Frame) *FramePadding {
+	header := frame.Header()
+
+	switch header.Type {
+	case http2.FrameData, http2.FrameHeaders, http2.FramePushPromise:
+	default:
+		return nil
+	}
+	// The PADDED flag is the same for the three frame types.
+	if !header.Flags.Has(http2.FlagDataPadded) || len(f.current) <= frameHeaderLen {
+		return nil
+	}
+
+	payload := f.current[frameHeaderLen:]
+	padLength := int(payload[0])
+	if padLength >= len(payload) {
+		return nil
+	}
+
+	p := &FramePadding{
+		PadLength:     uint8(padLength),
+		PayloadLength: uint32(len(payload) - 1 - padLength),
+	}
+	for _, b := range payload[len(payload)-padLength:] {
+		if b != 0 {
+			p.NonZero = true
 			break
-		} else {
-			callback(frame)
 		}
 	}
+
+	return p
 }
 
-func (f *Framer) ReadHeader(chunk []byte, callback func(hpack.HeaderField)) {
-	f.hfCallback = callback
-	f.decoder.Write(chunk)
-	f.hfCallback = nil
+// SetMaxFrameSize applies SETTINGS_MAX_FRAME_SIZE sent by the peer, which
+// limits the frames sent by this side.
+func (f *Framer) SetMaxFrameSize(size uint32) {
+	f.maxFrameSize = size
+	f.framer.SetMaxReadFrameSize(size)
 }
 
-func (f *Framer) SetMaxDynamicTableSize(size uint32) {
-	f.decoder.SetMaxDynamicTableSize(size)
+// SetHeaderTableSize applies SETTINGS_HEADER_TABLE_SIZE sent by the peer,
+// which limits the dynamic table that the encoder of this side may use.
+func (f *Framer) SetHeaderTableSize(size uint32) {
+	f.decoder.SetAllowedMaxDynamicTableSize(size)
+	f.table.Limit = size
+}
+
+// HeaderTable returns the state of the dynamic table, or nil once a header
+// block could not be decoded.
+func (f *Framer) HeaderTable() *HPACKTableState {
+	if f.hpackFailed {
+		return nil
+	}
+	return f.table.State()
 }
 
 func NewFramer(remote bool) *Framer {
@@ -85,14 +408,19 @@ func NewFramer(remote bool) *Framer {
 	framer := &Framer{
 		writeBuf: writeBuf,
 		readBuf:  readBuf,
-		chunkBuf: []byte{},
 		framer:   http2.NewFramer(writeBuf, readBuf),
+		table:    NewHPACKTable(4096),
 		preface:  !remote,
 	}
+	framer.SetMaxFrameSize(defaultMaxFrameSize)
+	framer.framer.AllowIllegalReads = true
 
 	framer.decoder = hpack.NewDecoder(4096, func(hf hpack.HeaderField) {
-		if framer.hfCallback != nil {
-			framer.hfCallback(hf)
+		if framer.fields != nil {
+			framer.fields = append(framer.fields, HeaderField{
+				Name:  hf.Name,
+				Value: hf.Value,
+			})
 		}
 	})
 
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestFramerPushPromiseContinuation(t *testing.T) {
+	var buf bytes.Buffer
+	w := http2.NewFramer(&buf, nil)
+	w.WritePushPromise(http2.PushPromiseParam{StreamID: 1, PromiseID: 2, BlockFragment: []byte{0x82}})
+	w.WriteContinuation(1, true, []byte{0x84})
+	w.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: []byte{0x88}, EndHeaders: true})
+
+	f := NewFramer(false)
+	blocks := []HeaderFields{}
+	callback := func(frame http2.Frame) error {
+		var fields HeaderFields
+		var fe *FrameError
+		switch frame := frame.(type) {
+		case *http2.PushPromiseFrame:
+			fields, _, fe = f.ReadHeader(frame.HeaderBlockFragment(), frame.HeadersEnded())
+		case *http2.ContinuationFrame:
+			fields, _, fe = f.ReadHeader(frame.HeaderBlockFragment(), frame.HeadersEnded())
+		case *http2.HeadersFrame:
+			fields, _, fe = f.ReadHeader(frame.HeaderBlockFragment(), frame.HeadersEnded())
+		}
+		if fe != nil {
+			t.Errorf("unexpected header error: %s", fe.Message)
+		}
+		if fields != nil {
+			blocks = append(blocks, fields)
+		}
+		return nil
+	}
+	errCallback := func(fe *FrameError) {
+		t.Errorf("unexpected frame error: %s", fe.Message)
+	}
+
+	f.ReadFrame(buf.Bytes(), callback, errCallback)
+
+	if len(blocks) != 2 {
+		t.Fatalf("got %d header blocks, want 2", len(blocks))
+	}
+	if len(blocks[0]) != 2 || blocks[0].Get(":method") != "GET" || blocks[0].Get(":path") != "/" {
+		t.Errorf("push promise block = %v, want :method GET and :path /", blocks[0])
+	}
+	if len(blocks[1]) != 1 || blocks[1].Get(":status") != "200" {
+		t.Errorf("headers block = %v, want :status 200 only", blocks[1])
+	}
+}
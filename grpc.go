@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const grpcPrefixLen = 5
+
+// grpcMaxMessageSize is the default limit of the messages that are held
+// until they are complete, which is the default maximum message size of
+// gRPC.
+const grpcMaxMessageSize = 4 << 20
+
+var grpcCodeName = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// GRPCMessage is a length-prefixed message carried by the DATA frames of a
+// gRPC stream.
+type GRPCMessage struct {
+	Compressed bool            `json:"compressed"`
+	Length     uint32          `json:"length"`
+	Frames     int             `json:"frames"`
+	Data       []byte          `json:"-"`
+	Type       string          `json:"type,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Fields     []WireField     `json:"fields,omitempty"`
+	Error      string          `json:"error,omitempty"`
+
+	// Skipped is set for a message above the size limit of the parser,
+	// whose data is not kept.
+	Skipped bool `json:"-"`
+}
+
+type GRPCStatus struct {
+	Code    int    `json:"code"`
+	Name    string `json:"name"`
+	Message string `json:"message,omitempty"`
+}
+
+func NewGRPCStatus(headers HeaderFields) *GRPCStatus {
+	if !headers.Has("grpc-status") {
+		return nil
+	}
+	value := headers.Get("grpc-status")
+
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		code = -1
+	}
+
+	status := &GRPCStatus{
+		Code: code,
+		Name: fmt.Sprintf("UNKNOWN_CODE_%s", value),
+	}
+	if code >= 0 && code < len(grpcCodeName) {
+		status.Name = grpcCodeName[code]
+	}
+
+	msg, err := url.PathUnescape(headers.Get("grpc-message"))
+	if err != nil {
+		msg = headers.Get("grpc-message")
+	}
+	status.Message = msg
+
+	return status
+}
+
+// GRPCParser splits the DATA payloads of one side of a stream into gRPC
+// messages. A message may span several DATA frames.
+type GRPCParser struct {
+	// MaxSize is the length above which a message is skipped instead of
+	// being held until it is complete.
+	MaxSize int
+
+	buf    []byte
+	frames int
+	skip   int
+}
+
+// Write adds the payload of a DATA frame and returns the messages that it
+// completes. A message above MaxSize is returned as skipped as soon as its
+// length is known.
+func (gp *GRPCParser) Write(data []byte) []*GRPCMessage {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if gp.skip > 0 {
+		n := gp.skip
+		if n > len(data) {
+			n = len(data)
+		}
+		data = data[n:]
+		gp.skip -= n
+		if len(data) == 0 {
+			return nil
+		}
+	}
+
+	gp.buf = append(gp.buf, data...)
+	gp.frames++
+
+	msgs := []*GRPCMessage{}
+	for len(gp.buf) >= grpcPrefixLen {
+		length := binary.BigEndian.Uint32(gp.buf[1:])
+		end := grpcPrefixLen + int(length)
+
+		if gp.MaxSize > 0 && int(length) > gp.MaxSize {
+			msgs = append(msgs, &GRPCMessage{
+				Compressed: gp.buf[0]&1 != 0,
+				Length:     length,
+				Frames:     gp.frames,
+				Skipped:    true,
+			})
+
+			if len(gp.buf) < end {
+				gp.skip = end - len(gp.buf)
+				end = len(gp.buf)
+			}
+			gp.buf = gp.buf[end:]
+			gp.frames = 1
+			continue
+		}
+
+		if len(gp.buf) < end {
+			break
+		}
+
+		msgs = append(msgs, &GRPCMessage{
+			Compressed: gp.buf[0]&1 != 0,
+			Length:     length,
+			Frames:     gp.frames,
+			Data:       gp.buf[grpcPrefixLen:end:end],
+		})
+
+		gp.buf = gp.buf[end:]
+		gp.frames = 1
+	}
+
+	if len(gp.buf) == 0 {
+		gp.buf = nil
+		gp.frames = 0
+	}
+
+	return msgs
+}
+
+// Pending returns the number of buffered bytes that do not form a complete
+// message yet.
+func (gp *GRPCParser) Pending() int {
+	return len(gp.buf)
+}
+
+func isGRPC(headers HeaderFields) bool {
+	return strings.HasPrefix(headers.Get("content-type"), "application/grpc")
+}
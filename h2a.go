@@ -8,6 +8,8 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 const VERSION = "v1.2.1"
@@ -17,6 +19,156 @@ var logger = log.New(os.Stderr, "", 0)
 type OriginConfig struct {
 	Addr   string
 	Direct bool
+	KeyLog io.Writer
+}
+
+type DumpConfig struct {
+	Formatter    Formatter
+	Capture      *PcapngWriter
+	HAR          *HARWriter
+	Bodies       *BodyWriter
+	Decode       bool
+	HPACK        bool
+	Priority     bool
+	GRPC         bool
+	Protos       *ProtoRegistry
+	LintDisabled map[string]bool
+	Recorder     *Recorder
+}
+
+// Close flushes the outputs that are shared by all connections.
+func (dc DumpConfig) Close() {
+	if dc.HAR != nil {
+		err := dc.HAR.Close()
+		if err != nil {
+			logger.Printf("Unable to write HAR file: %s\n", err)
+		}
+	}
+
+	if dc.Bodies != nil {
+		err := dc.Bodies.Close()
+		if err != nil {
+			logger.Printf("Unable to write body index: %s\n", err)
+		}
+	}
+
+	if dc.Capture != nil {
+		err := dc.Capture.Close()
+		if err != nil {
+			logger.Printf("Unable to write capture file: %s\n", err)
+		}
+	}
+}
+
+// DumpFlags are the output options shared by the proxy and the subcommands.
+type DumpFlags struct {
+	OutputLogFormat *string
+	HARPath         *string
+	HARBody         *bool
+	BodyDir         *string
+	BodyMax         *int
+	BodyText        *bool
+	Decode          *bool
+	HPACK           *bool
+	Priority        *bool
+	GRPC            *bool
+	ProtoSet        *string
+	ProtoDir        *string
+	LintDisable     *string
+	LintEnable      *string
+}
+
+func (df *DumpFlags) Usage() {
+	fmt.Println("  -o:             Output log format (default or json, Default: default)")
+	fmt.Println("  --har:          Write request/response exchanges to HAR file")
+	fmt.Println("  --har-body:     Include base64 encoded bodies in HAR file")
+	fmt.Println("  --body-dir:     Save request and response bodies to directory")
+	fmt.Println("  --body-max:     Maximum size of a saved body (Default: 10485760)")
+	fmt.Println("  --body-text:    Save text bodies only")
+	fmt.Println("  --decode:       Decode gzip, deflate, br and zstd encoded bodies")
+	fmt.Println("  --hpack:        Show HPACK dynamic table after each header block")
+	fmt.Println("  --priority:     Show stream priority tree when it changes")
+	fmt.Println("  --grpc:         Split gRPC streams into messages and show their status")
+	fmt.Println("  --proto-set:    Decode gRPC messages with FileDescriptorSet file")
+	fmt.Println("  --proto-dir:    Decode gRPC messages with .proto files in directory")
+	fmt.Println("  --lint-disable: Disable lint rules (comma separated, or all)")
+	fmt.Println("  --lint-enable:  Enable lint rules disabled by --lint-disable")
+}
+
+func (df *DumpFlags) Config() DumpConfig {
+	dumpConfig := DumpConfig{}
+	if *df.OutputLogFormat == "json" {
+		dumpConfig.Formatter = JSONFormatter
+	} else {
+		dumpConfig.Formatter = DefaultFormatter
+	}
+
+	if *df.HARPath != "" {
+		var err error
+		dumpConfig.HAR, err = NewHARWriter(*df.HARPath, *df.HARBody)
+		if err != nil {
+			logger.Fatalf("Unable to create HAR file: %s\n", err)
+		}
+	}
+
+	dumpConfig.Decode = *df.Decode
+	dumpConfig.HPACK = *df.HPACK
+	dumpConfig.Priority = *df.Priority
+	dumpConfig.GRPC = *df.GRPC
+
+	lintDisabled, err := ParseLintRules(*df.LintDisable, *df.LintEnable)
+	if err != nil {
+		logger.Fatalf("Invalid lint rules: %s\n", err)
+	}
+	dumpConfig.LintDisabled = lintDisabled
+
+	if *df.ProtoSet != "" || *df.ProtoDir != "" {
+		dumpConfig.Protos = NewProtoRegistry()
+		dumpConfig.GRPC = true
+
+		if *df.ProtoSet != "" {
+			err := dumpConfig.Protos.LoadSet(*df.ProtoSet)
+			if err != nil {
+				logger.Fatalf("Unable to load descriptor set: %s\n", err)
+			}
+		}
+
+		if *df.ProtoDir != "" {
+			err := dumpConfig.Protos.LoadDir(*df.ProtoDir)
+			if err != nil {
+				logger.Fatalf("Unable to load .proto files: %s\n", err)
+			}
+		}
+	}
+
+	if *df.BodyDir != "" {
+		var err error
+		dumpConfig.Bodies, err = NewBodyWriter(*df.BodyDir, *df.BodyMax, *df.BodyText)
+		if err != nil {
+			logger.Fatalf("Unable to create body directory: %s\n", err)
+		}
+	}
+
+	return dumpConfig
+}
+
+func NewDumpFlags(fs *flag.FlagSet) *DumpFlags {
+	return &DumpFlags{
+		OutputLogFormat: fs.String("o", "default", ""),
+		HARPath:         fs.String("har", "", ""),
+		HARBody:         fs.Bool("har-body", false, ""),
+		BodyDir:         fs.String("body-dir", "", ""),
+		BodyMax:         fs.Int("body-max", 10485760, ""),
+		BodyText:        fs.Bool("body-text", false, ""),
+		Decode:          fs.Bool("decode", false, ""),
+		HPACK:           fs.Bool("hpack", false, ""),
+		Priority:        fs.Bool("priority", false, ""),
+		GRPC:            fs.Bool("grpc", false, ""),
+		ProtoSet:        fs.String("proto-set", "", ""),
+		ProtoDir:        fs.String("proto-dir", "", ""),
+		LintDisable:     fs.String("lint-disable", "", ""),
+		LintEnable:      fs.String("lint-enable", "", ""),
+	}
 }
 
 func main() {
@@ -28,26 +180,45 @@ func main() {
 	originDirect := flag.Bool("D", false, "")
 	certPath := flag.String("c", "", "")
 	keyPath := flag.String("k", "", "")
-	outputLogFormat := flag.String("o", "default", "")
+	dumpFlags := NewDumpFlags(flag.CommandLine)
+	capturePath := flag.String("w", "", "")
+	keyLogPath := flag.String("l", os.Getenv("SSLKEYLOGFILE"), "")
+	recordPath := flag.String("record", "", "")
 	version := flag.Bool("version", false, "")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s replay [OPTIONS] FILE\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s analyze [OPTIONS] [FILE]\n\n", os.Args[0])
 		fmt.Println("Options:")
-		fmt.Println("  -p:        Port (Default: 443)")
-		fmt.Println("  -i:        IP Address (Default: 127.0.0.1)")
-		fmt.Println("  -d:        Use HTTP/2 direct mode")
-		fmt.Println("  -P:        Origin port")
-		fmt.Println("  -H:        Origin host")
-		fmt.Println("  -D:        Use HTTP/2 direct mode to connect origin")
-		fmt.Println("  -c:        Certificate file")
-		fmt.Println("  -k:        Certificate key file")
-		fmt.Println("  -o:        Output log format (default or json, Default: default)")
-		fmt.Println("  --version: Display version information and exit.")
-		fmt.Println("  --help:    Display this help and exit.")
+		fmt.Println("  -p:             Port (Default: 443)")
+		fmt.Println("  -i:             IP Address (Default: 127.0.0.1)")
+		fmt.Println("  -d:             Use HTTP/2 direct mode")
+		fmt.Println("  -P:             Origin port")
+		fmt.Println("  -H:             Origin host")
+		fmt.Println("  -D:             Use HTTP/2 direct mode to connect origin")
+		fmt.Println("  -c:             Certificate file")
+		fmt.Println("  -k:             Certificate key file")
+		dumpFlags.Usage()
+		fmt.Println("  -w:             Write decrypted traffic to pcapng file")
+		fmt.Println("  -l:             Write TLS keys to key log file (Default: $SSLKEYLOGFILE)")
+		fmt.Println("  --record:       Record the session to file for replay")
+		fmt.Println("  --version:      Display version information and exit.")
+		fmt.Println("  --help:         Display this help and exit.")
 		os.Exit(1)
 	}
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "analyze":
+			runAnalyze(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Parse()
 
 	if *version {
@@ -68,11 +239,50 @@ func main() {
 		Direct: *originDirect,
 	}
 
-	var formatter Formatter
-	if *outputLogFormat == "json" {
-		formatter = JSONFormatter
-	} else {
-		formatter = DefaultFormatter
+	if *keyLogPath != "" {
+		f, err := os.OpenFile(*keyLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			logger.Fatalf("Unable to open key log file: %s\n", err)
+		}
+		defer f.Close()
+
+		logger.Printf("Writing TLS keys to %s\n", *keyLogPath)
+		originConfig.KeyLog = f
+	}
+
+	dumpConfig := dumpFlags.Config()
+
+	if *capturePath != "" {
+		f, err := os.Create(*capturePath)
+		if err != nil {
+			logger.Fatalf("Unable to create capture file: %s\n", err)
+		}
+		defer f.Close()
+
+		dumpConfig.Capture, err = NewPcapngWriter(f)
+		if err != nil {
+			logger.Fatalf("Unable to write capture file: %s\n", err)
+		}
+	}
+
+	if dumpConfig.HAR != nil || dumpConfig.Bodies != nil || dumpConfig.Capture != nil {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigCh
+			dumpConfig.Close()
+			os.Exit(0)
+		}()
+	}
+
+	if *recordPath != "" {
+		f, err := os.Create(*recordPath)
+		if err != nil {
+			logger.Fatalf("Unable to create record file: %s\n", err)
+		}
+		defer f.Close()
+
+		dumpConfig.Recorder = NewRecorder(f)
 	}
 
 	var server net.Listener
@@ -87,6 +297,7 @@ func main() {
 
 		config := &tls.Config{}
 		config.Certificates = []tls.Certificate{cert}
+		config.KeyLogWriter = originConfig.KeyLog
 		config.NextProtos = append(config.NextProtos, "h2", "h2-16", "h2-15", "h2-14", "http/1.1")
 
 		server, err = tls.Listen("tcp", addr, config)
@@ -105,25 +316,27 @@ func main() {
 			continue
 		}
 
-		go handlePeer(remoteConn, originConfig, formatter)
+		go handlePeer(remoteConn, originConfig, dumpConfig)
 	}
 }
 
-func handlePeer(remoteConn net.Conn, originConfig OriginConfig, formatter Formatter) {
+func handlePeer(remoteConn net.Conn, originConfig OriginConfig, dumpConfig DumpConfig) {
 	var originConn net.Conn
+	var remoteFlow, originFlow *PcapngFlow
 	var err error
-	h2 := true
 	_, useTls := remoteConn.(*tls.Conn)
 
 	defer remoteConn.Close()
 
-	dumper := NewFrameDumper(remoteConn.RemoteAddr(), formatter)
+	dumper := NewFrameDumper(NewConnectionID(remoteConn.RemoteAddr()), remoteConn.RemoteAddr(), dumpConfig)
+	dumper.Connect()
 	defer dumper.Close()
 
 	remoteCh, remoteErrCh := handleConnection(remoteConn)
 	dumpDataCh, dumpDoneCh := handleFrameDumper(dumper)
 	defer func() {
-		dumpDoneCh <- true
+		close(dumpDataCh)
+		<-dumpDoneCh
 	}()
 
 	select {
@@ -133,16 +346,22 @@ func handlePeer(remoteConn net.Conn, originConfig OriginConfig, formatter Format
 		if useTls {
 			connState = remoteConn.(*tls.Conn).ConnectionState()
 
+			// Clients that do not use ALPN speak HTTP/1.1, which the
+			// dumper parses as such.
 			if connState.NegotiatedProtocol == "" {
 				connState.NegotiatedProtocol = "http/1.1"
 			}
-			if connState.NegotiatedProtocol == "http/1.1" {
-				h2 = true
-			}
 
 			dumper.DumpConnectionState(connState)
 		}
 
+		if dumpConfig.Recorder != nil {
+			dumpConfig.Recorder.Connect(dumper.ID, remoteConn.RemoteAddr(), connState.ServerName, connState.NegotiatedProtocol)
+			defer dumpConfig.Recorder.Close(dumper.ID)
+
+			dumpConfig.Recorder.Data(dumper.ID, chunk, true)
+		}
+
 		if originConfig.Direct {
 			originConn, err = net.Dial("tcp", originConfig.Addr)
 		} else {
@@ -152,6 +371,7 @@ func handlePeer(remoteConn net.Conn, originConfig OriginConfig, formatter Format
 				config.ServerName = connState.ServerName
 			}
 			config.InsecureSkipVerify = true
+			config.KeyLogWriter = originConfig.KeyLog
 			config.NextProtos = append(config.NextProtos, connState.NegotiatedProtocol)
 
 			originConn, err = tls.Dial("tcp", originConfig.Addr, config)
@@ -163,16 +383,27 @@ func handlePeer(remoteConn net.Conn, originConfig OriginConfig, formatter Format
 
 		defer originConn.Close()
 
+		if dumpConfig.Capture != nil {
+			remoteFlow = dumpConfig.Capture.NewFlow(remoteConn.RemoteAddr(), remoteConn.LocalAddr(), dumper.ID)
+			defer remoteFlow.Close()
+			originFlow = dumpConfig.Capture.NewFlow(originConn.LocalAddr(), originConn.RemoteAddr(), dumper.ID)
+			defer originFlow.Close()
+
+			remoteFlow.Write(chunk, true)
+		}
+
 		_, err = originConn.Write(chunk)
 		if err != nil {
 			logger.Printf("Unable to write data to the origin: %s", err)
 			return
 		}
 
-		if h2 {
-			dumpDataCh <- &DumpData{chunk, true}
+		if originFlow != nil {
+			originFlow.Write(chunk, true)
 		}
 
+		dumpDataCh <- &DumpData{chunk, true}
+
 	case err := <-remoteErrCh:
 		if err != io.EOF {
 			logger.Printf("Connection error: %s", err)
@@ -185,16 +416,25 @@ func handlePeer(remoteConn net.Conn, originConfig OriginConfig, formatter Format
 	for {
 		select {
 		case chunk := <-remoteCh:
+			if dumpConfig.Recorder != nil {
+				dumpConfig.Recorder.Data(dumper.ID, chunk, true)
+			}
+			if remoteFlow != nil {
+				remoteFlow.Write(chunk, true)
+			}
+
 			_, err := originConn.Write(chunk)
 			if err != nil {
 				logger.Printf("Unable to write data to the origin: %s", err)
 				return
 			}
 
-			if h2 {
-				dumpDataCh <- &DumpData{chunk, true}
+			if originFlow != nil {
+				originFlow.Write(chunk, true)
 			}
 
+			dumpDataCh <- &DumpData{chunk, true}
+
 		case err := <-remoteErrCh:
 			if err != io.EOF {
 				logger.Printf("Connection error: %s", err)
@@ -203,16 +443,25 @@ func handlePeer(remoteConn net.Conn, originConfig OriginConfig, formatter Format
 			return
 
 		case chunk := <-originCh:
+			if dumpConfig.Recorder != nil {
+				dumpConfig.Recorder.Data(dumper.ID, chunk, false)
+			}
+			if originFlow != nil {
+				originFlow.Write(chunk, false)
+			}
+
 			_, err := remoteConn.Write(chunk)
 			if err != nil {
 				logger.Printf("Unable to write data to the connection: %s", err)
 				return
 			}
 
-			if h2 {
-				dumpDataCh <- &DumpData{chunk, false}
+			if remoteFlow != nil {
+				remoteFlow.Write(chunk, false)
 			}
 
+			dumpDataCh <- &DumpData{chunk, false}
+
 		case err := <-originErrCh:
 			if err != io.EOF {
 				logger.Printf("Origin error: %s", err)
@@ -243,19 +492,18 @@ func handleConnection(conn net.Conn) (<-chan []byte, <-chan error) {
 	return dataCh, errCh
 }
 
+// handleFrameDumper dumps the chunks sent to the returned data channel. Once
+// the data channel is closed and all chunks are dumped, the done channel is
+// closed.
 func handleFrameDumper(dumper *FrameDumper) (chan *DumpData, chan bool) {
 	dataCh := make(chan *DumpData, 1024)
-	doneCh := make(chan bool, 1)
+	doneCh := make(chan bool)
 
 	go func() {
-		for {
-			select {
-			case d := <-dataCh:
-				dumper.DumpFrame(d.Chunk, d.Remote)
-			case <-doneCh:
-				break
-			}
+		for d := range dataCh {
+			dumper.DumpFrame(d.Chunk, d.Remote)
 		}
+		close(doneCh)
 	}()
 
 	return dataCh, doneCh
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Connection      string      `json:"connection"`
+	StreamID        uint32      `json:"_streamId"`
+
+	start int64
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+	Trailers    []HARNameValue `json:"_trailers,omitempty"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+	Trailers    []HARNameValue `json:"_trailers,omitempty"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type HARContent struct {
+	Size        int    `json:"size"`
+	Compression int    `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+}
+
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// HARWriter collects exchanges from all connections and writes them as a
+// HAR 1.2 log when it is closed.
+type HARWriter struct {
+	Body bool
+
+	mu      sync.Mutex
+	file    *os.File
+	entries []HAREntry
+}
+
+func (hw *HARWriter) Add(ex *Exchange) {
+	if ex.Request == nil {
+		return
+	}
+
+	entry := NewHAREntry(ex, hw.Body)
+
+	hw.mu.Lock()
+	hw.entries = append(hw.entries, entry)
+	hw.mu.Unlock()
+}
+
+func (hw *HARWriter) Close() error {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	sort.SliceStable(hw.entries, func(i, j int) bool {
+		return hw.entries[i].start < hw.entries[j].start
+	})
+
+	har := HAR{
+		Log: HARLog{
+			Version: "1.2",
+			Creator: HARCreator{Name: "h2a", Version: VERSION},
+			Entries: hw.entries,
+		},
+	}
+	if har.Log.Entries == nil {
+		har.Log.Entries = []HAREntry{}
+	}
+
+	encoder := json.NewEncoder(hw.file)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(har)
+	if err != nil {
+		hw.file.Close()
+		return err
+	}
+
+	return hw.file.Close()
+}
+
+func NewHARWriter(path string, body bool) (*HARWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hw := &HARWriter{
+		Body: body,
+		file: f,
+	}
+
+	return hw, nil
+}
+
+func NewHAREntry(ex *Exchange, body bool) HAREntry {
+	req := ex.Request
+	res := ex.Response
+	if res == nil {
+		res = &Message{}
+	}
+
+	entry := HAREntry{
+		StartedDateTime: time.Unix(0, req.Start).Format(time.RFC3339Nano),
+		Connection:      ex.ConnectionID,
+		StreamID:        ex.StreamID,
+		start:           req.Start,
+	}
+
+	entry.Request = HARRequest{
+		Method:      req.Headers.Get(":method"),
+		URL:         harURL(req.Headers),
+		HTTPVersion: ex.HTTPVersion,
+		Cookies:     harRequestCookies(req.Headers),
+		Headers:     harNameValues(req.Headers),
+		QueryString: harQueryString(req.Headers.Get(":path")),
+		HeadersSize: -1,
+		BodySize:    req.BodySize,
+		Trailers:    harNameValues(req.Trailers),
+	}
+	if req.BodySize > 0 {
+		entry.Request.PostData = &HARPostData{
+			MimeType: req.Headers.Get("content-type"),
+		}
+		if body {
+			if utf8.Valid(req.Body) {
+				entry.Request.PostData.Text = string(req.Body)
+			} else {
+				entry.Request.PostData.Text = base64.StdEncoding.EncodeToString(req.Body)
+				entry.Request.PostData.Encoding = "base64"
+			}
+		}
+	}
+
+	status, _ := strconv.Atoi(res.Headers.Get(":status"))
+	entry.Response = HARResponse{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HTTPVersion: ex.HTTPVersion,
+		Cookies:     harResponseCookies(res.Headers),
+		Headers:     harNameValues(res.Headers),
+		Content: HARContent{
+			Size:     res.BodySize,
+			MimeType: res.Headers.Get("content-type"),
+		},
+		RedirectURL: res.Headers.Get("location"),
+		HeadersSize: -1,
+		BodySize:    res.BodySize,
+		Trailers:    harNameValues(res.Trailers),
+	}
+	content := res.Body
+	if res.Decoder != nil && res.Decoder.Err == nil {
+		content = res.Decoder.Decoded
+		entry.Response.Content.Size = res.Decoder.DecodedSize
+		entry.Response.Content.Compression = res.Decoder.DecodedSize - res.BodySize
+	}
+	if body && res.BodySize > 0 {
+		entry.Response.Content.Text = base64.StdEncoding.EncodeToString(content)
+		entry.Response.Content.Encoding = "base64"
+	}
+
+	entry.Timings = HARTimings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: -1,
+		SSL:     -1,
+	}
+	if req.Ended {
+		entry.Timings.Send = harDuration(req.Start, req.End)
+	}
+	if res.Start > 0 {
+		entry.Timings.Wait = harDuration(req.End, res.Start)
+	}
+	if res.Ended {
+		entry.Timings.Receive = harDuration(res.Start, res.End)
+	}
+	entry.Time = entry.Timings.Send + entry.Timings.Wait + entry.Timings.Receive
+
+	return entry
+}
+
+func harDuration(start int64, end int64) float64 {
+	if start == 0 || end < start {
+		return 0
+	}
+
+	return float64(end-start) / float64(time.Millisecond)
+}
+
+func harURL(headers HeaderFields) string {
+	authority := headers.Get(":authority")
+	if authority == "" {
+		authority = headers.Get("host")
+	}
+
+	scheme := headers.Get(":scheme")
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + authority + headers.Get(":path")
+}
+
+func harNameValues(headers HeaderFields) []HARNameValue {
+	nvs := make([]HARNameValue, 0, len(headers))
+	for _, hf := range headers {
+		nvs = append(nvs, HARNameValue{Name: hf.Name, Value: hf.Value})
+	}
+
+	return nvs
+}
+
+func harQueryString(path string) []HARNameValue {
+	nvs := []HARNameValue{}
+
+	i := strings.IndexByte(path, '?')
+	if i < 0 {
+		return nvs
+	}
+
+	for _, kv := range strings.Split(path[i+1:], "&") {
+		if kv == "" {
+			continue
+		}
+		nv := HARNameValue{}
+		nv.Name, nv.Value, _ = strings.Cut(kv, "=")
+		nvs = append(nvs, nv)
+	}
+
+	return nvs
+}
+
+func harRequestCookies(headers HeaderFields) []HARCookie {
+	cookies := []HARCookie{}
+
+	r := http.Request{Header: http.Header{}}
+	for _, v := range headers.Values("cookie") {
+		r.Header.Add("Cookie", v)
+	}
+	for _, c := range r.Cookies() {
+		cookies = append(cookies, HARCookie{Name: c.Name, Value: c.Value})
+	}
+
+	return cookies
+}
+
+func harResponseCookies(headers HeaderFields) []HARCookie {
+	cookies := []HARCookie{}
+
+	r := http.Response{Header: http.Header{}}
+	for _, v := range headers.Values("set-cookie") {
+		r.Header.Add("Set-Cookie", v)
+	}
+	for _, c := range r.Cookies() {
+		hc := HARCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			hc.Expires = c.Expires.Format(time.RFC3339)
+		}
+		cookies = append(cookies, hc)
+	}
+
+	return cookies
+}
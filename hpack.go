@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+)
+
+// Representations of a header field in an HPACK header block (RFC 7541,
+// Section 6).
+const (
+	HeaderIndexed         = "indexed"
+	HeaderIncremental     = "incremental_indexing"
+	HeaderWithoutIndexing = "without_indexing"
+	HeaderNeverIndexed    = "never_indexed"
+)
+
+var errHPACKNeedMore = errors.New("need more data")
+
+// hpackField is the encoding of a header field or of a dynamic table size
+// update, as found in a header block.
+type hpackField struct {
+	Representation string
+	Index          uint64
+	NameHuffman    bool
+	ValueHuffman   bool
+	Size           int
+
+	// SizeUpdate is set for dynamic table size updates, which carry the new
+	// size in Index.
+	SizeUpdate bool
+}
+
+// scanHeaderBlock parses the representations in a header block without
+// decoding them. It returns the number of bytes consumed, which is less than
+// len(b) when the block ends in the middle of a representation.
+func scanHeaderBlock(b []byte) ([]hpackField, int, error) {
+	fields := []hpackField{}
+	consumed := 0
+
+	for consumed < len(b) {
+		field, n, err := scanHeaderField(b[consumed:])
+		if err == errHPACKNeedMore {
+			break
+		}
+		if err != nil {
+			return fields, consumed, err
+		}
+
+		fields = append(fields, field)
+		consumed += n
+	}
+
+	return fields, consumed, nil
+}
+
+func scanHeaderField(b []byte) (hpackField, int, error) {
+	field := hpackField{}
+
+	var prefix uint8
+	var literal bool
+
+	switch {
+	case b[0]&0x80 != 0:
+		field.Representation = HeaderIndexed
+		prefix = 7
+	case b[0]&0xc0 == 0x40:
+		field.Representation = HeaderIncremental
+		prefix = 6
+		literal = true
+	case b[0]&0xe0 == 0x20:
+		field.SizeUpdate = true
+		prefix = 5
+	case b[0]&0xf0 == 0x10:
+		field.Representation = HeaderNeverIndexed
+		prefix = 4
+		literal = true
+	default:
+		field.Representation = HeaderWithoutIndexing
+		prefix = 4
+		literal = true
+	}
+
+	index, n, err := readHPACKInt(b, prefix)
+	if err != nil {
+		return field, 0, err
+	}
+	field.Index = index
+
+	if literal {
+		if index == 0 {
+			huffman, m, err := readHPACKString(b[n:])
+			if err != nil {
+				return field, 0, err
+			}
+			field.NameHuffman = huffman
+			n += m
+		}
+
+		huffman, m, err := readHPACKString(b[n:])
+		if err != nil {
+			return field, 0, err
+		}
+		field.ValueHuffman = huffman
+		n += m
+	}
+
+	field.Size = n
+
+	return field, n, nil
+}
+
+func readHPACKInt(b []byte, prefix uint8) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errHPACKNeedMore
+	}
+
+	mask := uint64(1)<<prefix - 1
+	v := uint64(b[0]) & mask
+	if v < mask {
+		return v, 1, nil
+	}
+
+	var shift uint
+	for i := 1; i < len(b); i++ {
+		if shift > 56 {
+			return 0, 0, errors.New("integer overflow")
+		}
+		v += uint64(b[i]&0x7f) << shift
+		shift += 7
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+
+	return 0, 0, errHPACKNeedMore
+}
+
+func readHPACKString(b []byte) (bool, int, error) {
+	if len(b) == 0 {
+		return false, 0, errHPACKNeedMore
+	}
+
+	huffman := b[0]&0x80 != 0
+	length, n, err := readHPACKInt(b, 7)
+	if err != nil {
+		return false, 0, err
+	}
+	if uint64(len(b)-n) < length {
+		return false, 0, errHPACKNeedMore
+	}
+
+	return huffman, n + int(length), nil
+}
+
+// hpackEntryOverhead is the overhead of each entry in the dynamic table
+// (RFC 7541, Section 4.1).
+const hpackEntryOverhead = 32
+
+// hpackStaticTableLen is the number of entries in the static table. The
+// dynamic table starts at the next index.
+const hpackStaticTableLen = 61
+
+type HPACKEntry struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Size  uint32 `json:"size"`
+}
+
+// HPACKTableState is the dynamic table of a decoder after a header block.
+type HPACKTableState struct {
+	Size        uint32       `json:"size"`
+	MaxSize     uint32       `json:"max_size"`
+	Limit       uint32       `json:"limit"`
+	Entries     []HPACKEntry `json:"entries"`
+	Evicted     []HPACKEntry `json:"evicted,omitempty"`
+	SizeUpdates []uint32     `json:"size_updates,omitempty"`
+}
+
+// HPACKTable mirrors the dynamic table of an hpack.Decoder, which does not
+// expose its contents.
+type HPACKTable struct {
+	// MaxSize is the size set by the encoder, and Limit is the largest size
+	// that the decoder allows with SETTINGS_HEADER_TABLE_SIZE.
+	MaxSize uint32
+	Limit   uint32
+
+	size    uint32
+	entries []HPACKEntry
+
+	evicted     []HPACKEntry
+	sizeUpdates []uint32
+}
+
+func (ht *HPACKTable) Add(name string, value string) {
+	entry := HPACKEntry{
+		Name:  name,
+		Value: value,
+		Size:  uint32(len(name)+len(value)) + hpackEntryOverhead,
+	}
+
+	// An entry larger than the table empties it without being added.
+	if entry.Size > ht.MaxSize {
+		ht.evict(0)
+		return
+	}
+
+	ht.evict(ht.MaxSize - entry.Size)
+	ht.entries = append([]HPACKEntry{entry}, ht.entries...)
+	ht.size += entry.Size
+}
+
+func (ht *HPACKTable) SetMaxSize(size uint32) {
+	ht.MaxSize = size
+	ht.sizeUpdates = append(ht.sizeUpdates, size)
+	ht.evict(size)
+}
+
+// State returns the contents of the table together with the evictions and
+// size updates since the previous call.
+func (ht *HPACKTable) State() *HPACKTableState {
+	state := &HPACKTableState{
+		Size:        ht.size,
+		MaxSize:     ht.MaxSize,
+		Limit:       ht.Limit,
+		Entries:     make([]HPACKEntry, len(ht.entries)),
+		Evicted:     ht.evicted,
+		SizeUpdates: ht.sizeUpdates,
+	}
+
+	for i, entry := range ht.entries {
+		entry.Index = hpackStaticTableLen + 1 + i
+		state.Entries[i] = entry
+	}
+
+	ht.evicted = nil
+	ht.sizeUpdates = nil
+
+	return state
+}
+
+func (ht *HPACKTable) evict(size uint32) {
+	for ht.size > size && len(ht.entries) > 0 {
+		last := len(ht.entries) - 1
+		entry := ht.entries[last]
+		entry.Index = hpackStaticTableLen + 1 + last
+
+		ht.evicted = append(ht.evicted, entry)
+		ht.entries = ht.entries[:last]
+		ht.size -= entry.Size
+	}
+}
+
+func NewHPACKTable(size uint32) *HPACKTable {
+	return &HPACKTable{
+		MaxSize: size,
+		Limit:   size,
+		entries: []HPACKEntry{},
+	}
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// maxHTTP1HeadSize limits the header section, and each line, of an HTTP/1.x
+// message that h2a waits for.
+const maxHTTP1HeadSize = 65536
+
+// Ways the end of the body of an HTTP/1.x message is found (RFC 9112,
+// Section 6.3).
+const (
+	HTTP1FramingNone          = "none"
+	HTTP1FramingContentLength = "content-length"
+	HTTP1FramingChunked       = "chunked"
+	HTTP1FramingClose         = "close"
+)
+
+const (
+	http1StateHead = iota
+	http1StateBody
+	http1StateChunkSize
+	http1StateChunkData
+	http1StateChunkEnd
+	http1StateTrailers
+	http1StateClose
+
+	// http1StateWait holds the requests that follow an upgrade or CONNECT
+	// request until the response tells whether they are HTTP/1.x.
+	http1StateWait
+
+	// http1StateDone is set once the connection is upgraded, or the stream
+	// cannot be parsed, after which nothing more is parsed.
+	http1StateDone
+)
+
+// HTTP1Message is a request or a response of an HTTP/1.x connection. Header
+// fields keep the case they were sent with.
+type HTTP1Message struct {
+	Method        string       `json:"method,omitempty"`
+	Target        string       `json:"target,omitempty"`
+	Status        int          `json:"status,omitempty"`
+	Reason        string       `json:"reason,omitempty"`
+	Version       string       `json:"version"`
+	Headers       HeaderFields `json:"headers"`
+	Framing       string       `json:"framing"`
+	ContentLength int64        `json:"content_length,omitempty"`
+	KeepAlive     bool         `json:"keep_alive"`
+
+	// Set once the body has been read.
+	BodySize int64        `json:"body_size"`
+	Chunks   int          `json:"chunks,omitempty"`
+	Trailers HeaderFields `json:"trailers,omitempty"`
+
+	// offset is where the message starts in the byte stream of its side.
+	offset int64
+}
+
+// Request reports whether the message is a request.
+func (m *HTTP1Message) Request() bool {
+	return m.Method != ""
+}
+
+// Interim reports whether the message is an interim response, which is
+// followed by another response to the same request. A 101 response ends the
+// exchange, as what follows it is another protocol.
+func (m *HTTP1Message) Interim() bool {
+	return m.Status >= 100 && m.Status < 200 && m.Status != 101
+}
+
+// UpgradeH2C reports whether the message asks for, or switches to, HTTP/2
+// over cleartext TCP (RFC 7540, Section 3.2).
+func (m *HTTP1Message) UpgradeH2C() bool {
+	return hasHTTP1Token(http1Header(m.Headers, "upgrade"), "h2c")
+}
+
+// HTTP2Settings decodes the HTTP2-Settings header field of an upgrade
+// request, which is the payload of a SETTINGS frame encoded with base64url
+// (RFC 7540, Section 3.2.1).
+func (m *HTTP1Message) HTTP2Settings() (*http2.SettingsFrame, error) {
+	values := http1Headers(m.Headers, "http2-settings")
+	if len(values) != 1 {
+		return nil, fmt.Errorf("%d HTTP2-Settings header fields in upgrade request", len(values))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP2-Settings: %s", err)
+	}
+
+	var buf bytes.Buffer
+	framer := http2.NewFramer(&buf, &buf)
+	err = framer.WriteRawFrame(http2.FrameSettings, 0, 0, payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP2-Settings: %s", err)
+	}
+
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP2-Settings: %s", err)
+	}
+
+	return frame.(*http2.SettingsFrame), nil
+}
+
+// HeaderFields returns the header fields of the message as they would be
+// sent in HTTP/2, with pseudo-header fields and lowercase names (RFC 9113,
+// Section 8.3).
+func (m *HTTP1Message) HeaderFields(scheme string) HeaderFields {
+	fields := HeaderFields{}
+
+	if m.Request() {
+		fields = append(fields,
+			HeaderField{Name: ":method", Value: m.Method},
+			HeaderField{Name: ":scheme", Value: scheme},
+			HeaderField{Name: ":authority", Value: http1Header(m.Headers, "host")},
+			HeaderField{Name: ":path", Value: m.Target},
+		)
+	} else {
+		fields = append(fields, HeaderField{Name: ":status", Value: strconv.Itoa(m.Status)})
+	}
+
+	for _, hf := range m.Headers {
+		name := strings.ToLower(hf.Name)
+		if name == "host" {
+			continue
+		}
+		fields = append(fields, HeaderField{Name: name, Value: hf.Value})
+	}
+
+	return fields
+}
+
+// HTTP1Part is what the parser read of a message: its header section, a piece
+// of its body, or its end. Messages are numbered from 1 in the order of the
+// requests, and a response has the number of its request.
+type HTTP1Part struct {
+	StreamID uint32
+	Remote   bool
+	Message  *HTTP1Message
+	Headers  bool
+	Data     []byte
+	End      bool
+}
+
+type http1Request struct {
+	streamID uint32
+	message  *HTTP1Message
+}
+
+type http1Reader struct {
+	remote bool
+	buf    []byte
+	offset int64
+	state  int
+
+	// remaining is what is left of the body or the chunk being read.
+	remaining int64
+	message   *HTTP1Message
+	streamID  uint32
+}
+
+// consume drops bytes from the start of buf.
+func (r *http1Reader) consume(n int) {
+	r.buf = r.buf[n:]
+	r.offset += int64(n)
+}
+
+// readLine returns the next line without its line ending, which may be a bare
+// LF (RFC 9112, Section 2.2).
+func (r *http1Reader) readLine() (string, bool, *FrameError) {
+	i := bytes.IndexByte(r.buf, '\n')
+	if i < 0 {
+		if len(r.buf) > maxHTTP1HeadSize {
+			return "", false, r.fail("line longer than %d bytes", maxHTTP1HeadSize)
+		}
+		return "", false, nil
+	}
+
+	line := strings.TrimSuffix(string(r.buf[:i]), "\r")
+	r.consume(i + 1)
+
+	return line, true, nil
+}
+
+// fail stops parsing the stream and returns the error at the current offset.
+func (r *http1Reader) fail(format string, args ...interface{}) *FrameError {
+	r.state = http1StateDone
+
+	return &FrameError{
+		Offset:  r.offset,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// HTTP1Parser reads the requests and responses of an HTTP/1.x connection,
+// including pipelined requests, from the byte streams of both sides.
+type HTTP1Parser struct {
+	// Scheme is the scheme of the requests, which HTTP/1.x does not send.
+	Scheme string
+
+	// Upgrade is the response that switched the connection to another
+	// protocol, or that made it a tunnel, once it has been read, and
+	// UpgradeRequest the request it answered.
+	Upgrade        *HTTP1Message
+	UpgradeRequest *HTTP1Message
+
+	// H2C is set when Upgrade switched the connection to HTTP/2 over
+	// cleartext TCP (RFC 7540, Section 3.2). Over TLS, h2c does not apply
+	// and the switch is left alone like any other protocol.
+	H2C bool
+
+	remote   *http1Reader
+	origin   *http1Reader
+	requests []http1Request
+	nextID   uint32
+}
+
+// Read adds a chunk of the byte stream of the client if remote is set, or of
+// the server otherwise, and returns what it completes. Once a stream cannot
+// be parsed, the error is returned and the rest of it is ignored.
+func (p *HTTP1Parser) Read(chunk []byte, remote bool) ([]HTTP1Part, *FrameError) {
+	r := p.origin
+	if remote {
+		r = p.remote
+	}
+	if r.state == http1StateDone {
+		return nil, nil
+	}
+	r.buf = append(r.buf, chunk...)
+
+	parts := []HTTP1Part{}
+	err := p.parse(r, &parts)
+
+	// A response can let the requests that waited for it go on.
+	if err == nil && !remote && p.remote.state == http1StateHead {
+		err = p.parse(p.remote, &parts)
+	}
+
+	return parts, err
+}
+
+// Close ends the bodies that are delimited by the end of the connection.
+func (p *HTTP1Parser) Close() []HTTP1Part {
+	parts := []HTTP1Part{}
+	for _, r := range []*http1Reader{p.remote, p.origin} {
+		if r.state == http1StateClose {
+			p.endMessage(r, &parts)
+		}
+	}
+
+	return parts
+}
+
+// Rest returns the bytes of a side that follow the upgrade of the
+// connection.
+func (p *HTTP1Parser) Rest(remote bool) []byte {
+	if remote {
+		return p.remote.buf
+	}
+	return p.origin.buf
+}
+
+func (p *HTTP1Parser) parse(r *http1Reader, parts *[]HTTP1Part) *FrameError {
+	for {
+		var more bool
+		var err *FrameError
+
+		switch r.state {
+		case http1StateHead:
+			more, err = p.readHead(r, parts)
+		case http1StateBody, http1StateChunkData, http1StateClose:
+			more = p.readBody(r, parts)
+		case http1StateChunkSize:
+			more, err = p.readChunkSize(r)
+		case http1StateChunkEnd:
+			more, err = p.readChunkEnd(r)
+		case http1StateTrailers:
+			more, err = p.readTrailers(r, parts)
+		}
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+func (p *HTTP1Parser) readHead(r *http1Reader, parts *[]HTTP1Part) (bool, *FrameError) {
+	// Empty lines before a request line are ignored (RFC 9112, Section 2.2).
+	for r.remote && len(r.buf) > 0 && (r.buf[0] == '\r' || r.buf[0] == '\n') {
+		r.consume(1)
+	}
+	if len(r.buf) == 0 {
+		return false, nil
+	}
+
+	end := -1
+	for _, sep := range []string{"\n\r\n", "\n\n"} {
+		i := bytes.Index(r.buf, []byte(sep))
+		if i >= 0 && (end < 0 || i+len(sep) < end) {
+			end = i + len(sep)
+		}
+	}
+	if end < 0 {
+		if len(r.buf) > maxHTTP1HeadSize {
+			return false, r.fail("header section longer than %d bytes", maxHTTP1HeadSize)
+		}
+		return false, nil
+	}
+
+	lines := strings.Split(strings.TrimRight(string(r.buf[:end]), "\r\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	m := &HTTP1Message{offset: r.offset}
+	var ok bool
+	if r.remote {
+		ok = parseHTTP1RequestLine(lines[0], m)
+	} else {
+		ok = parseHTTP1StatusLine(lines[0], m)
+	}
+	if !ok {
+		if r.remote {
+			return false, r.fail("invalid request line %q", lines[0])
+		}
+		return false, r.fail("invalid status line %q", lines[0])
+	}
+
+	m.Headers = HeaderFields{}
+	for _, line := range lines[1:] {
+		if !addHTTP1Field(&m.Headers, line) {
+			return false, r.fail("invalid header field %q", line)
+		}
+	}
+
+	// The message is numbered after the headers are valid, so that numbers
+	// are not used by messages that fail.
+	var method string
+	if r.remote {
+		p.nextID++
+		r.streamID = p.nextID
+		p.requests = append(p.requests, http1Request{streamID: r.streamID, message: m})
+	} else if len(p.requests) > 0 {
+		r.streamID = p.requests[0].streamID
+		method = p.requests[0].message.Method
+	} else {
+		// A response without a request takes the next number.
+		p.nextID++
+		r.streamID = p.nextID
+	}
+
+	err := setHTTP1Framing(m, method)
+	if err != "" {
+		return false, r.fail("%s", err)
+	}
+
+	r.consume(end)
+	r.message = m
+	*parts = append(*parts, HTTP1Part{StreamID: r.streamID, Remote: r.remote, Message: m, Headers: true})
+
+	switch m.Framing {
+	case HTTP1FramingContentLength:
+		r.state = http1StateBody
+		r.remaining = m.ContentLength
+	case HTTP1FramingChunked:
+		r.state = http1StateChunkSize
+	case HTTP1FramingClose:
+		r.state = http1StateClose
+	default:
+		p.endMessage(r, parts)
+	}
+
+	return r.state != http1StateDone && r.state != http1StateWait, nil
+}
+
+func (p *HTTP1Parser) readBody(r *http1Reader, parts *[]HTTP1Part) bool {
+	if len(r.buf) == 0 {
+		return false
+	}
+
+	n := int64(len(r.buf))
+	if r.state != http1StateClose && n > r.remaining {
+		n = r.remaining
+	}
+
+	data := append([]byte{}, r.buf[:n]...)
+	r.consume(int(n))
+	r.message.BodySize += n
+	*parts = append(*parts, HTTP1Part{StreamID: r.streamID, Remote: r.remote, Message: r.message, Data: data})
+
+	if r.state == http1StateClose {
+		return false
+	}
+
+	r.remaining -= n
+	if r.remaining > 0 {
+		return false
+	}
+
+	if r.state == http1StateChunkData {
+		r.state = http1StateChunkEnd
+	} else {
+		p.endMessage(r, parts)
+	}
+
+	return r.state != http1StateDone && r.state != http1StateWait
+}
+
+func (p *HTTP1Parser) readChunkSize(r *http1Reader) (bool, *FrameError) {
+	offset := r.offset
+	line, ok, err := r.readLine()
+	if !ok {
+		return false, err
+	}
+
+	// Chunk extensions are ignored (RFC 9112, Section 7.1.1).
+	sizeStr, _, _ := strings.Cut(line, ";")
+	size, perr := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+	if perr != nil || size < 0 {
+		r.offset = offset
+		return false, r.fail("invalid chunk size %q", line)
+	}
+
+	if size == 0 {
+		r.state = http1StateTrailers
+		return true, nil
+	}
+
+	r.message.Chunks++
+	r.remaining = size
+	r.state = http1StateChunkData
+
+	return true, nil
+}
+
+func (p *HTTP1Parser) readChunkEnd(r *http1Reader) (bool, *FrameError) {
+	offset := r.offset
+	line, ok, err := r.readLine()
+	if !ok {
+		return false, err
+	}
+	if line != "" {
+		r.offset = offset
+		return false, r.fail("chunk data not followed by CRLF")
+	}
+
+	r.state = http1StateChunkSize
+
+	return true, nil
+}
+
+func (p *HTTP1Parser) readTrailers(r *http1Reader, parts *[]HTTP1Part) (bool, *FrameError) {
+	offset := r.offset
+	line, ok, err := r.readLine()
+	if !ok {
+		return false, err
+	}
+
+	if line == "" {
+		p.endMessage(r, parts)
+		return r.state != http1StateDone && r.state != http1StateWait, nil
+	}
+
+	if r.message.Trailers == nil {
+		r.message.Trailers = HeaderFields{}
+	}
+	if !addHTTP1Field(&r.message.Trailers, line) {
+		r.offset = offset
+		return false, r.fail("invalid trailer field %q", line)
+	}
+
+	return true, nil
+}
+
+// endMessage ends the message being read, and sets what the stream carries
+// next.
+func (p *HTTP1Parser) endMessage(r *http1Reader, parts *[]HTTP1Part) {
+	m := r.message
+	r.state = http1StateHead
+
+	if r.remote {
+		*parts = append(*parts, HTTP1Part{StreamID: r.streamID, Remote: true, Message: m, End: true})
+
+		// What follows an upgrade or CONNECT request depends on the
+		// response (RFC 9110, Sections 7.8 and 9.3.6).
+		if m.Method == "CONNECT" || http1Header(m.Headers, "upgrade") != "" {
+			r.state = http1StateWait
+		}
+		return
+	}
+
+	var req *HTTP1Message
+	if len(p.requests) > 0 && p.requests[0].streamID == r.streamID {
+		req = p.requests[0].message
+	}
+
+	// Interim responses have no end of their own, and are followed by the
+	// final response. So does the switch to h2c, as the response to the
+	// upgrade request is sent on stream 1.
+	h2c := m.Status == 101 && p.Scheme == "http" && m.UpgradeH2C()
+	if !m.Interim() && !h2c {
+		*parts = append(*parts, HTTP1Part{StreamID: r.streamID, Remote: false, Message: m, End: true})
+		if req != nil {
+			p.requests = p.requests[1:]
+		}
+	}
+
+	if m.Status == 101 || (req != nil && req.Method == "CONNECT" && m.Status >= 200 && m.Status < 300) {
+		p.Upgrade = m
+		p.UpgradeRequest = req
+		p.H2C = h2c
+		p.remote.state = http1StateDone
+		p.origin.state = http1StateDone
+		return
+	}
+
+	if !m.Interim() && p.remote.state == http1StateWait {
+		p.remote.state = http1StateHead
+	}
+}
+
+func NewHTTP1Parser(scheme string) *HTTP1Parser {
+	return &HTTP1Parser{
+		Scheme: scheme,
+		remote: &http1Reader{remote: true},
+		origin: &http1Reader{},
+	}
+}
+
+// parseHTTP1RequestLine parses "method SP request-target SP HTTP-version"
+// (RFC 9112, Section 3).
+func parseHTTP1RequestLine(line string, m *HTTP1Message) bool {
+	fields := strings.Split(line, " ")
+	if len(fields) != 3 || fields[0] == "" || fields[1] == "" || !validHTTP1Version(fields[2]) {
+		return false
+	}
+
+	m.Method, m.Target, m.Version = fields[0], fields[1], fields[2]
+
+	return true
+}
+
+// parseHTTP1StatusLine parses "HTTP-version SP status-code SP
+// [reason-phrase]" (RFC 9112, Section 4).
+func parseHTTP1StatusLine(line string, m *HTTP1Message) bool {
+	version, rest, _ := strings.Cut(line, " ")
+	code, reason, _ := strings.Cut(rest, " ")
+
+	status, err := strconv.Atoi(code)
+	if !validHTTP1Version(version) || len(code) != 3 || err != nil || status < 100 {
+		return false
+	}
+
+	m.Version, m.Status, m.Reason = version, status, reason
+
+	return true
+}
+
+func validHTTP1Version(version string) bool {
+	return len(version) == 8 && strings.HasPrefix(version, "HTTP/") && version[6] == '.'
+}
+
+// addHTTP1Field adds a field line to fields. A line that starts with
+// whitespace continues the value of the previous field (RFC 9112, Section
+// 5.2).
+func addHTTP1Field(fields *HeaderFields, line string) bool {
+	if line[0] == ' ' || line[0] == '\t' {
+		if len(*fields) == 0 {
+			return false
+		}
+		last := &(*fields)[len(*fields)-1]
+		last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(line))
+		return true
+	}
+
+	name, value, ok := strings.Cut(line, ":")
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return false
+	}
+
+	*fields = append(*fields, HeaderField{Name: name, Value: strings.TrimSpace(value)})
+
+	return true
+}
+
+// setHTTP1Framing sets how the body of a message ends, given the method of
+// the request for responses. It returns why the framing is invalid, if it is
+// (RFC 9112, Section 6.3).
+func setHTTP1Framing(m *HTTP1Message, method string) string {
+	connection := http1Header(m.Headers, "connection")
+	if m.Version == "HTTP/1.0" {
+		m.KeepAlive = hasHTTP1Token(connection, "keep-alive")
+	} else {
+		m.KeepAlive = !hasHTTP1Token(connection, "close")
+	}
+
+	m.Framing = HTTP1FramingNone
+	if !m.Request() {
+		if method == "HEAD" || m.Status < 200 || m.Status == 204 || m.Status == 304 {
+			return ""
+		}
+		if method == "CONNECT" && m.Status < 300 {
+			return ""
+		}
+	}
+
+	codings := strings.Split(http1Header(m.Headers, "transfer-encoding"), ",")
+	if len(codings) > 1 || codings[0] != "" {
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			m.Framing = HTTP1FramingChunked
+			return ""
+		}
+		if m.Request() {
+			return "transfer-encoding of a request does not end with chunked"
+		}
+		m.Framing = HTTP1FramingClose
+		m.KeepAlive = false
+		return ""
+	}
+
+	lengths := http1Headers(m.Headers, "content-length")
+	if len(lengths) > 0 {
+		// Repeated values are allowed as long as they are the same.
+		for _, l := range strings.Split(strings.Join(lengths, ","), ",") {
+			length, err := strconv.ParseInt(strings.TrimSpace(l), 10, 64)
+			if err != nil || length < 0 || (m.Framing != HTTP1FramingNone && length != m.ContentLength) {
+				return fmt.Sprintf("invalid content-length %q", strings.Join(lengths, ", "))
+			}
+			m.Framing = HTTP1FramingContentLength
+			m.ContentLength = length
+		}
+		if m.ContentLength == 0 {
+			m.Framing = HTTP1FramingNone
+		}
+		return ""
+	}
+
+	if !m.Request() {
+		m.Framing = HTTP1FramingClose
+		m.KeepAlive = false
+	}
+
+	return ""
+}
+
+// http1Header returns the values of the fields with a name, in any case,
+// joined by commas.
+func http1Header(fields HeaderFields, name string) string {
+	return strings.Join(http1Headers(fields, name), ", ")
+}
+
+func http1Headers(fields HeaderFields, name string) []string {
+	values := []string{}
+	for _, hf := range fields {
+		if strings.EqualFold(hf.Name, name) {
+			values = append(values, hf.Value)
+		}
+	}
+
+	return values
+}
+
+// hasHTTP1Token reports whether a comma separated list has a token, in any
+// case.
+func hasHTTP1Token(list string, token string) bool {
+	for _, t := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+
+	return false
+}
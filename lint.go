@@ -0,0 +1,496 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// LintRule is a check of the protocol conformance of the traffic.
+type LintRule struct {
+	ID          string
+	Severity    string
+	Section     string
+	Description string
+}
+
+var lintRules = []LintRule{
+	{"stream-state", SeverityError, "RFC 9113, Section 5.1", "Frame not allowed in the state of its stream"},
+	{"stream-id", SeverityError, "RFC 9113, Section 5.1.1", "Stream ID reused, not increasing or of the wrong parity"},
+	{"settings-ack", SeverityWarning, "RFC 9113, Section 6.5.3", "SETTINGS not acknowledged, or ACK without SETTINGS"},
+	{"flow-control", SeverityError, "RFC 9113, Section 6.9.1", "DATA beyond the flow-control window, or a window above 2^31-1"},
+	{"frame-size", SeverityError, "RFC 9113, Section 4.2", "Frame larger than SETTINGS_MAX_FRAME_SIZE, or a setting out of range"},
+	{"padding", SeverityError, "RFC 9113, Section 6.1", "Padding with non-zero bytes"},
+	{"header-uppercase", SeverityError, "RFC 9113, Section 8.2.1", "Uppercase character in a header field name"},
+	{"connection-header", SeverityError, "RFC 9113, Section 8.2.2", "Connection-specific header field"},
+	{"pseudo-header", SeverityError, "RFC 9113, Section 8.3", "Misplaced, unknown, duplicated or missing pseudo-header field"},
+	{"content-length", SeverityError, "RFC 9113, Section 8.1.1", "content-length that disagrees with the DATA sent"},
+}
+
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+var requestPseudoHeaders = map[string]bool{
+	":method":    true,
+	":scheme":    true,
+	":authority": true,
+	":path":      true,
+	":protocol":  true,
+}
+
+// Problem is a violation of a lint rule.
+type Problem struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Section  string `json:"section"`
+	Message  string `json:"message"`
+}
+
+func newProblem(rule string, format string, args ...interface{}) Problem {
+	p := Problem{
+		Rule:    rule,
+		Message: fmt.Sprintf(format, args...),
+	}
+
+	for _, r := range lintRules {
+		if r.ID == rule {
+			p.Severity = r.Severity
+			p.Section = r.Section
+			break
+		}
+	}
+
+	return p
+}
+
+// ParseLintRules returns the set of disabled rules from comma separated
+// lists of rules to disable and to enable. "all" matches every rule, and
+// enabled rules take precedence.
+func ParseLintRules(disable string, enable string) (map[string]bool, error) {
+	disabled := map[string]bool{}
+
+	parse := func(list string, value bool) error {
+		for _, id := range strings.Split(list, ",") {
+			id = strings.TrimSpace(id)
+			if id == "" {
+				continue
+			}
+
+			if id == "all" {
+				for _, r := range lintRules {
+					disabled[r.ID] = value
+				}
+				continue
+			}
+
+			found := false
+			for _, r := range lintRules {
+				if r.ID == id {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("unknown lint rule: %s", id)
+			}
+			disabled[id] = value
+		}
+
+		return nil
+	}
+
+	err := parse(disable, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parse(enable, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return disabled, nil
+}
+
+// lintMessage is what the linter knows about one side of a stream.
+type lintMessage struct {
+	final         bool
+	method        string
+	status        string
+	contentLength int64
+	dataSize      int64
+}
+
+// lintBlock is a header block that is not complete yet.
+type lintBlock struct {
+	streamID  uint32
+	push      bool
+	endStream bool
+}
+
+// Linter checks the decoded frames of a connection against the rules that
+// are not disabled.
+type Linter struct {
+	Disabled map[string]bool
+
+	// Pending SETTINGS by sender.
+	remoteSettings int
+	originSettings int
+
+	// Header blocks continued by CONTINUATION frames, per sender.
+	remoteBlock lintBlock
+	originBlock lintBlock
+
+	requests  map[uint32]*lintMessage
+	responses map[uint32]*lintMessage
+}
+
+// Filter drops the problems of disabled rules.
+func (l *Linter) Filter(problems []Problem) []Problem {
+	filtered := []Problem{}
+	for _, p := range problems {
+		if !l.Disabled[p.Rule] {
+			filtered = append(filtered, p)
+		}
+	}
+
+	return filtered
+}
+
+// HandleFrame checks a frame sent by the client if remote is set, or by the
+// server otherwise.
+func (l *Linter) HandleFrame(e *Event, frame http2.Frame, remote bool) []Problem {
+	problems := []Problem{}
+	report := func(rule string, format string, args ...interface{}) {
+		problems = append(problems, newProblem(rule, format, args...))
+	}
+
+	sender, peer := "client", "server"
+	if !remote {
+		sender, peer = peer, sender
+	}
+
+	// Frames larger than SETTINGS_MAX_FRAME_SIZE are not decoded, and are
+	// reported by the framer instead.
+	header := frame.Header()
+
+	var padding *FramePadding
+	switch p := e.Frame.Payload.(type) {
+	case DataFramePayload:
+		padding = p.Padding
+	case HeadersFramePayload:
+		padding = p.Padding
+	case PushPromiseFramePayload:
+		padding = p.Padding
+	}
+	if padding != nil && padding.NonZero {
+		report("padding", "%s frame from %s has non-zero padding", header.Type, sender)
+	}
+
+	switch frame := frame.(type) {
+	case *http2.SettingsFrame:
+		if frame.IsAck() {
+			pending := &l.originSettings
+			if !remote {
+				pending = &l.remoteSettings
+			}
+			if *pending == 0 {
+				report("settings-ack", "SETTINGS ACK from %s without pending SETTINGS from %s", sender, peer)
+			} else {
+				*pending--
+			}
+			break
+		}
+
+		if remote {
+			l.remoteSettings++
+		} else {
+			l.originSettings++
+		}
+
+		windowSize, ok := frame.Value(http2.SettingInitialWindowSize)
+		if ok && windowSize > maxWindowSize {
+			report("flow-control", "SETTINGS_INITIAL_WINDOW_SIZE %d from %s exceeds %d", windowSize, sender, maxWindowSize)
+		}
+
+		frameSize, ok := frame.Value(http2.SettingMaxFrameSize)
+		if ok && (frameSize < defaultMaxFrameSize || frameSize > maxFrameSize) {
+			report("frame-size", "SETTINGS_MAX_FRAME_SIZE %d from %s is not between %d and %d", frameSize, sender, defaultMaxFrameSize, maxFrameSize)
+		}
+
+	case *http2.HeadersFrame:
+		p := e.Frame.Payload.(HeadersFramePayload)
+		block := lintBlock{header.StreamID, false, frame.StreamEnded()}
+		problems = append(problems, l.headerFragment(block, remote, frame.HeadersEnded(), p.HeaderFields)...)
+
+	case *http2.PushPromiseFrame:
+		p := e.Frame.Payload.(PushPromiseFramePayload)
+		block := lintBlock{frame.PromiseID, true, false}
+		problems = append(problems, l.headerFragment(block, remote, frame.HeadersEnded(), p.HeaderFields)...)
+
+	case *http2.ContinuationFrame:
+		p := e.Frame.Payload.(ContinuationFramePayload)
+		block := l.originBlock
+		if remote {
+			block = l.remoteBlock
+		}
+		problems = append(problems, l.headerFragment(block, remote, frame.HeadersEnded(), p.HeaderFields)...)
+
+	case *http2.DataFrame:
+		p := e.Frame.Payload.(DataFramePayload)
+		if p.WindowSize.Connection.Overrun() {
+			report("flow-control", "DATA from %s exceeds the connection window of %s", sender, peer)
+		}
+		if p.WindowSize.Stream.Overrun() {
+			report("flow-control", "DATA from %s exceeds the window of stream %d", sender, header.StreamID)
+		}
+
+		m := l.message(header.StreamID, remote)
+		m.dataSize += int64(len(frame.Data()))
+		if frame.StreamEnded() {
+			problems = append(problems, l.endStream(header.StreamID, remote)...)
+		}
+
+	case *http2.WindowUpdateFrame:
+		p := e.Frame.Payload.(WindowUpdateFramePayload)
+		if p.WindowSize.Connection.Overflow() {
+			report("flow-control", "WINDOW_UPDATE from %s makes the connection window exceed %d", sender, maxWindowSize)
+		}
+		if p.WindowSize.Stream.Overflow() {
+			report("flow-control", "WINDOW_UPDATE from %s makes the window of stream %d exceed %d", sender, header.StreamID, maxWindowSize)
+		}
+
+	case *http2.RSTStreamFrame:
+		delete(l.requests, header.StreamID)
+		delete(l.responses, header.StreamID)
+	}
+
+	return problems
+}
+
+// Close reports the problems that are found at the end of the connection.
+func (l *Linter) Close() []Problem {
+	problems := []Problem{}
+
+	if l.remoteSettings > 0 {
+		problems = append(problems, newProblem("settings-ack", "%d SETTINGS from client not acknowledged by server", l.remoteSettings))
+	}
+	if l.originSettings > 0 {
+		problems = append(problems, newProblem("settings-ack", "%d SETTINGS from server not acknowledged by client", l.originSettings))
+	}
+
+	return problems
+}
+
+// headerFragment checks a header block once it is complete, and the end of
+// the stream if the block ends it.
+func (l *Linter) headerFragment(block lintBlock, remote bool, end bool, fields HeaderFields) []Problem {
+	if !end {
+		if remote {
+			l.remoteBlock = block
+		} else {
+			l.originBlock = block
+		}
+		return nil
+	}
+
+	problems := l.headerBlock(block.streamID, remote, block.push, fields)
+	if block.endStream {
+		problems = append(problems, l.endStream(block.streamID, remote)...)
+	}
+
+	return problems
+}
+
+// Upgrade records the request that upgraded the connection from HTTP/1.1,
+// whose response is sent on stream 1.
+func (l *Linter) Upgrade(method string) {
+	l.requests[1] = &lintMessage{final: true, method: method, contentLength: -1}
+}
+
+func (l *Linter) message(streamID uint32, remote bool) *lintMessage {
+	messages := l.responses
+	if remote {
+		messages = l.requests
+	}
+
+	m, ok := messages[streamID]
+	if !ok {
+		m = &lintMessage{contentLength: -1}
+		messages[streamID] = m
+	}
+
+	return m
+}
+
+// headerBlock checks a complete header block. Requests are sent by the
+// client or promised by the server.
+func (l *Linter) headerBlock(streamID uint32, remote bool, push bool, fields HeaderFields) []Problem {
+	problems := []Problem{}
+	report := func(rule string, format string, args ...interface{}) {
+		problems = append(problems, newProblem(rule, format, args...))
+	}
+
+	request := remote || push
+	m := l.message(streamID, request)
+
+	kind := "response"
+	switch {
+	case m.final:
+		kind = "trailers"
+	case request:
+		kind = "request"
+	}
+
+	pseudo := map[string]string{}
+	regular := false
+	for _, hf := range fields {
+		if hf.Name != strings.ToLower(hf.Name) {
+			report("header-uppercase", "header field name %q in %s is not lowercase", hf.Name, kind)
+		}
+
+		if !strings.HasPrefix(hf.Name, ":") {
+			regular = true
+
+			if connectionHeaders[hf.Name] {
+				report("connection-header", "connection-specific header field %q in %s", hf.Name, kind)
+			}
+			if hf.Name == "te" && hf.Value != "trailers" {
+				report("connection-header", "te header field with value %q other than \"trailers\"", hf.Value)
+			}
+			continue
+		}
+
+		switch {
+		case kind == "trailers":
+			report("pseudo-header", "pseudo-header field %s in trailers", hf.Name)
+		case regular:
+			report("pseudo-header", "pseudo-header field %s after regular header fields", hf.Name)
+		case kind == "request" && !requestPseudoHeaders[hf.Name]:
+			report("pseudo-header", "pseudo-header field %s not allowed in request", hf.Name)
+		case kind == "response" && hf.Name != ":status":
+			report("pseudo-header", "pseudo-header field %s not allowed in response", hf.Name)
+		}
+
+		if _, ok := pseudo[hf.Name]; ok {
+			report("pseudo-header", "pseudo-header field %s appears more than once", hf.Name)
+		}
+		pseudo[hf.Name] = hf.Value
+	}
+
+	missing := []string{}
+	switch kind {
+	case "request":
+		if _, ok := pseudo[":method"]; !ok {
+			missing = append(missing, ":method")
+		}
+		if pseudo[":method"] == "CONNECT" && pseudo[":protocol"] == "" {
+			if _, ok := pseudo[":authority"]; !ok {
+				missing = append(missing, ":authority")
+			}
+			for _, name := range []string{":scheme", ":path"} {
+				if _, ok := pseudo[name]; ok {
+					report("pseudo-header", "pseudo-header field %s not allowed in CONNECT request", name)
+				}
+			}
+		} else {
+			for _, name := range []string{":scheme", ":path"} {
+				if pseudo[name] == "" {
+					missing = append(missing, name)
+				}
+			}
+		}
+		m.method = pseudo[":method"]
+	case "response":
+		if _, ok := pseudo[":status"]; !ok {
+			missing = append(missing, ":status")
+		}
+		m.status = pseudo[":status"]
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		report("pseudo-header", "%s without %s", kind, strings.Join(missing, ", "))
+	}
+
+	// Informational responses are followed by another header block.
+	if kind == "response" && strings.HasPrefix(m.status, "1") {
+		return problems
+	}
+
+	if kind != "trailers" {
+		m.final = true
+
+		values := fields.Values("content-length")
+		if len(values) > 0 {
+			n, err := strconv.ParseInt(values[0], 10, 64)
+			if err != nil || n < 0 {
+				report("content-length", "invalid content-length %q in %s", values[0], kind)
+			} else {
+				m.contentLength = n
+			}
+			for _, v := range values[1:] {
+				if v != values[0] {
+					report("content-length", "conflicting content-length values %q and %q in %s", values[0], v, kind)
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+func (l *Linter) endStream(streamID uint32, remote bool) []Problem {
+	m := l.message(streamID, remote)
+
+	// The request is kept until the response ends, for its method.
+	if !remote {
+		defer func() {
+			delete(l.requests, streamID)
+			delete(l.responses, streamID)
+		}()
+	}
+
+	if m.contentLength < 0 || m.contentLength == m.dataSize {
+		return nil
+	}
+
+	kind := "request"
+	if !remote {
+		kind = "response"
+
+		// Responses to HEAD and 304 responses carry no content.
+		req, ok := l.requests[streamID]
+		if (ok && req.method == "HEAD") || m.status == "304" {
+			return nil
+		}
+	}
+
+	return []Problem{
+		newProblem("content-length", "%s with content-length %d ended after %d bytes of DATA", kind, m.contentLength, m.dataSize),
+	}
+}
+
+func NewLinter(disabled map[string]bool) *Linter {
+	if disabled == nil {
+		disabled = map[string]bool{}
+	}
+
+	return &Linter{
+		Disabled:  disabled,
+		requests:  map[uint32]*lintMessage{},
+		responses: map[uint32]*lintMessage{},
+	}
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+
+	// Number of consecutive frames that must parse before a byte offset is
+	// accepted as a frame boundary.
+	frameSyncDepth = 3
+)
+
+// PcapPacket is a packet read from a pcap or pcapng file.
+type PcapPacket struct {
+	Time     int64
+	LinkType uint32
+	Data     []byte
+}
+
+// ReadPcap reads all packets of a pcap or pcapng file.
+func ReadPcap(r io.Reader) ([]PcapPacket, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, errors.New("file is too short")
+	}
+
+	if binary.LittleEndian.Uint32(data) == pcapngBlockSHB {
+		return readPcapng(data)
+	}
+
+	return readPcapClassic(data)
+}
+
+func readPcapClassic(data []byte) ([]PcapPacket, error) {
+	if len(data) < 24 {
+		return nil, errors.New("invalid pcap header")
+	}
+
+	var order binary.ByteOrder
+	var nano bool
+	switch binary.LittleEndian.Uint32(data) {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xa1b23c4d:
+		order, nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nano = binary.BigEndian, true
+	default:
+		return nil, errors.New("unknown capture file format")
+	}
+
+	linkType := order.Uint32(data[20:]) & 0x0fffffff
+	data = data[24:]
+
+	packets := []PcapPacket{}
+	for len(data) >= 16 {
+		sec := int64(order.Uint32(data))
+		frac := int64(order.Uint32(data[4:]))
+		capLen := int(order.Uint32(data[8:]))
+		if len(data) < 16+capLen {
+			break
+		}
+
+		if !nano {
+			frac *= 1000
+		}
+
+		packets = append(packets, PcapPacket{
+			Time:     sec*1e9 + frac,
+			LinkType: linkType,
+			Data:     data[16 : 16+capLen],
+		})
+		data = data[16+capLen:]
+	}
+
+	return packets, nil
+}
+
+type pcapngInterface struct {
+	linkType uint32
+	tsUnit   int64 // nanoseconds per tick, or 0 for sub-nanosecond ticks
+	tsDiv    int64
+}
+
+func readPcapng(data []byte) ([]PcapPacket, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	interfaces := []pcapngInterface{}
+	packets := []PcapPacket{}
+
+	for len(data) >= 12 {
+		if binary.LittleEndian.Uint32(data) == pcapngBlockSHB {
+			switch binary.LittleEndian.Uint32(data[8:]) {
+			case 0x1A2B3C4D:
+				order = binary.LittleEndian
+			case 0x4D3C2B1A:
+				order = binary.BigEndian
+			default:
+				return nil, errors.New("invalid pcapng byte order")
+			}
+			interfaces = interfaces[:0]
+		}
+
+		blockType := order.Uint32(data)
+		blockLen := int(order.Uint32(data[4:]))
+		if blockLen < 12 || blockLen > len(data) {
+			break
+		}
+		body := data[8 : blockLen-4]
+		data = data[blockLen:]
+
+		switch blockType {
+		case pcapngBlockIDB:
+			if len(body) < 8 {
+				continue
+			}
+			iface := pcapngInterface{
+				linkType: uint32(order.Uint16(body)),
+				tsUnit:   1000,
+			}
+			readPcapngOptions(body[8:], order, func(code uint16, value []byte) {
+				if code != 9 || len(value) < 1 {
+					return
+				}
+				resol := value[0]
+				var div int64 = 1
+				if resol&0x80 != 0 {
+					div = 1 << (resol & 0x7f)
+				} else {
+					for i := byte(0); i < resol; i++ {
+						div *= 10
+					}
+				}
+				if div <= 1e9 {
+					iface.tsUnit = 1e9 / div
+				} else {
+					iface.tsUnit, iface.tsDiv = 0, div
+				}
+			})
+			interfaces = append(interfaces, iface)
+
+		case pcapngBlockEPB:
+			if len(body) < 20 {
+				continue
+			}
+			id := int(order.Uint32(body))
+			if id >= len(interfaces) {
+				continue
+			}
+			ts := int64(order.Uint32(body[4:]))<<32 | int64(order.Uint32(body[8:]))
+			capLen := int(order.Uint32(body[12:]))
+			if len(body) < 20+capLen {
+				continue
+			}
+
+			iface := interfaces[id]
+			var t int64
+			if iface.tsUnit > 0 {
+				t = ts * iface.tsUnit
+			} else {
+				t = ts / iface.tsDiv * 1e9
+			}
+
+			packets = append(packets, PcapPacket{
+				Time:     t,
+				LinkType: iface.linkType,
+				Data:     body[20 : 20+capLen],
+			})
+
+		case 3: // Simple Packet Block
+			if len(body) < 4 || len(interfaces) == 0 {
+				continue
+			}
+			packets = append(packets, PcapPacket{
+				LinkType: interfaces[0].linkType,
+				Data:     body[4:],
+			})
+		}
+	}
+
+	return packets, nil
+}
+
+func readPcapngOptions(data []byte, order binary.ByteOrder, callback func(uint16, []byte)) {
+	for len(data) >= 4 {
+		code := order.Uint16(data)
+		n := int(order.Uint16(data[2:]))
+		if code == pcapngOptEnd || len(data) < 4+n {
+			return
+		}
+
+		callback(code, data[4:4+n])
+		data = data[4+n+(4-n%4)%4:]
+	}
+}
+
+// tcpSegment is the part of a TCP packet needed for stream reassembly.
+type tcpSegment struct {
+	time    int64
+	src     *net.TCPAddr
+	dst     *net.TCPAddr
+	seq     uint32
+	flags   uint8
+	payload []byte
+}
+
+func decodeTCPSegment(p PcapPacket) (*tcpSegment, bool) {
+	data := p.Data
+
+	switch p.LinkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			if len(data) < 4 {
+				return nil, false
+			}
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+	case linkTypeNull, linkTypeLoop:
+		if len(data) < 4 {
+			return nil, false
+		}
+		data = data[4:]
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		data = data[16:]
+	case linkTypeSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		data = data[20:]
+	case linkTypeRaw, 12, 14, linkTypeIPv4, linkTypeIPv6:
+	default:
+		return nil, false
+	}
+
+	if len(data) < 1 {
+		return nil, false
+	}
+
+	var srcIP, dstIP net.IP
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil, false
+		}
+		hl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		if data[9] != 6 || hl < 20 || total < hl || len(data) < hl {
+			return nil, false
+		}
+		// Fragmented packets are not reassembled.
+		if binary.BigEndian.Uint16(data[6:])&0x3fff != 0 {
+			return nil, false
+		}
+		srcIP, dstIP = net.IP(data[12:16]), net.IP(data[16:20])
+		if total < len(data) {
+			data = data[:total]
+		}
+		data = data[hl:]
+
+	case 6:
+		if len(data) < 40 {
+			return nil, false
+		}
+		next := data[6]
+		srcIP, dstIP = net.IP(data[8:24]), net.IP(data[24:40])
+		plen := int(binary.BigEndian.Uint16(data[4:]))
+		data = data[40:]
+		if plen < len(data) {
+			data = data[:plen]
+		}
+		for next == 0 || next == 43 || next == 60 {
+			if len(data) < 8 || len(data) < 8+int(data[1])*8 {
+				return nil, false
+			}
+			next = data[0]
+			data = data[8+int(data[1])*8:]
+		}
+		if next != 6 {
+			return nil, false
+		}
+
+	default:
+		return nil, false
+	}
+
+	if len(data) < 20 {
+		return nil, false
+	}
+	off := int(data[12]>>4) * 4
+	if off < 20 || len(data) < off {
+		return nil, false
+	}
+
+	seg := &tcpSegment{
+		time:    p.Time,
+		src:     &net.TCPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(data))},
+		dst:     &net.TCPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(data[2:]))},
+		seq:     binary.BigEndian.Uint32(data[4:]),
+		flags:   data[13],
+		payload: data[off:],
+	}
+
+	return seg, true
+}
+
+// tcpHalf reassembles the bytes sent in one direction of a TCP connection.
+type tcpHalf struct {
+	addr    *net.TCPAddr
+	syn     bool
+	started bool
+	nextSeq uint32
+	pending map[uint32]*tcpSegment
+	chunks  []*Record
+}
+
+func (h *tcpHalf) add(seg *tcpSegment) {
+	if seg.flags&tcpFlagSYN != 0 {
+		h.syn = true
+		h.started = true
+		h.nextSeq = seg.seq + 1
+		return
+	}
+	if len(seg.payload) == 0 {
+		return
+	}
+	if !h.started {
+		h.started = true
+		h.nextSeq = seg.seq
+	}
+
+	h.pending[seg.seq] = seg
+	h.reassemble()
+}
+
+// reassemble adds the pending segments that continue the byte stream.
+func (h *tcpHalf) reassemble() {
+	for {
+		progress := false
+		for seq, s := range h.pending {
+			diff := int32(h.nextSeq - seq)
+			if diff < 0 {
+				continue
+			}
+
+			delete(h.pending, seq)
+			if int(diff) < len(s.payload) {
+				payload := s.payload[diff:]
+				h.chunks = append(h.chunks, &Record{Time: s.time, Type: RecordData, Data: payload})
+				h.nextSeq += uint32(len(payload))
+			}
+			progress = true
+		}
+		if !progress {
+			break
+		}
+	}
+}
+
+// flush gives up on the bytes that never arrived. Each hole in the sequence
+// numbers becomes a gap record, and reassembly goes on with the segment after
+// it.
+func (h *tcpHalf) flush() {
+	for len(h.pending) > 0 {
+		var next *tcpSegment
+		for _, s := range h.pending {
+			if next == nil || s.seq-h.nextSeq < next.seq-h.nextSeq {
+				next = s
+			}
+		}
+
+		h.chunks = append(h.chunks, &Record{Time: next.time, Type: RecordGap, Length: int64(next.seq - h.nextSeq)})
+		h.nextSeq = next.seq
+		h.reassemble()
+	}
+}
+
+// resync skips the bytes after each gap up to the first complete frame.
+func (h *tcpHalf) resync() {
+	for i, c := range h.chunks {
+		if c.Type != RecordGap {
+			continue
+		}
+
+		rest := &tcpHalf{chunks: h.chunks[i+1:]}
+		head := rest.head(1 << 20)
+		n, ok := findFrameBoundary(head)
+		if !ok {
+			n = len(head)
+		}
+		c.Skip = int64(n)
+		rest.skipData(n)
+	}
+}
+
+// skipData drops the first n reassembled bytes up to the next gap, leaving
+// the chunks in place.
+func (h *tcpHalf) skipData(n int) {
+	for _, c := range h.chunks {
+		if n == 0 || c.Type == RecordGap {
+			return
+		}
+		k := len(c.Data)
+		if k > n {
+			k = n
+		}
+		c.Data = c.Data[k:]
+		n -= k
+	}
+}
+
+// skip drops the first n reassembled bytes.
+func (h *tcpHalf) skip(n int) {
+	for n > 0 && len(h.chunks) > 0 {
+		c := h.chunks[0]
+		if len(c.Data) > n {
+			c.Data = c.Data[n:]
+			return
+		}
+		n -= len(c.Data)
+		h.chunks = h.chunks[1:]
+	}
+}
+
+func (h *tcpHalf) head(max int) []byte {
+	buf := []byte{}
+	for _, c := range h.chunks {
+		if len(buf) >= max || c.Type == RecordGap {
+			break
+		}
+		buf = append(buf, c.Data...)
+	}
+
+	return buf
+}
+
+type tcpFlow struct {
+	halves [2]*tcpHalf
+	start  int64
+	end    int64
+	closed bool
+}
+
+func (f *tcpFlow) half(addr *net.TCPAddr) *tcpHalf {
+	for i, h := range f.halves {
+		if h == nil {
+			f.halves[i] = &tcpHalf{addr: addr, pending: map[uint32]*tcpSegment{}}
+			return f.halves[i]
+		}
+		if h.addr.IP.Equal(addr.IP) && h.addr.Port == addr.Port {
+			return h
+		}
+	}
+
+	return nil
+}
+
+// client returns the index of the half sent by the client. The sender of the
+// SYN wins, then the sender of the connection preface, then the higher port.
+func (f *tcpFlow) client() int {
+	if f.halves[1] == nil {
+		return 0
+	}
+
+	for i, h := range f.halves {
+		if h.syn && !f.halves[1-i].syn {
+			return i
+		}
+	}
+
+	preface := []byte(http2.ClientPreface)
+	for i, h := range f.halves {
+		if bytes.Contains(h.head(4096), preface) {
+			return i
+		}
+	}
+
+	if f.halves[0].addr.Port > f.halves[1].addr.Port {
+		return 0
+	}
+	return 1
+}
+
+// PcapRecords reassembles the TCP connections of a capture and returns the
+// HTTP/2 traffic in them as a session.
+func PcapRecords(packets []PcapPacket) []*Record {
+	flows := map[string]*tcpFlow{}
+	order := []*tcpFlow{}
+
+	for _, p := range packets {
+		seg, ok := decodeTCPSegment(p)
+		if !ok {
+			continue
+		}
+
+		key := seg.src.String() + "-" + seg.dst.String()
+		if seg.dst.String() < seg.src.String() {
+			key = seg.dst.String() + "-" + seg.src.String()
+		}
+
+		flow, ok := flows[key]
+		if !ok || (flow.closed && seg.flags&tcpFlagSYN != 0 && seg.flags&tcpFlagACK == 0) {
+			flow = &tcpFlow{start: seg.time}
+			flows[key] = flow
+			order = append(order, flow)
+		}
+
+		flow.half(seg.src).add(seg)
+		flow.end = seg.time
+		if seg.flags&(tcpFlagFIN|tcpFlagRST) != 0 {
+			flow.closed = true
+		}
+	}
+
+	records := []*Record{}
+	for _, flow := range order {
+		records = append(records, flowRecords(flow)...)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time < records[j].Time
+	})
+
+	return records
+}
+
+func flowRecords(flow *tcpFlow) []*Record {
+	c := flow.client()
+	client := flow.halves[c]
+	server := flow.halves[1-c]
+
+	h2 := false
+	for _, h := range flow.halves {
+		if h == nil {
+			continue
+		}
+		h.flush()
+		h.resync()
+
+		head := h.head(1 << 20)
+		if h == client && bytes.HasPrefix(head, []byte(http2.ClientPreface)) {
+			h2 = true
+			continue
+		}
+
+		offset, ok := findFrameBoundary(head)
+		if !ok {
+			continue
+		}
+		if h == client {
+			if i := bytes.Index(head, []byte(http2.ClientPreface)); i >= 0 && i <= offset {
+				offset = i
+			}
+		}
+
+		h.skip(offset)
+		h2 = true
+	}
+	if !h2 {
+		return nil
+	}
+
+	id := NewConnectionID(client.addr)
+	records := []*Record{
+		{Time: flow.start, ConnectionID: id, Type: RecordConnect, Remote: true, RemoteAddr: client.addr.String()},
+	}
+
+	for _, h := range flow.halves {
+		if h == nil {
+			continue
+		}
+		for _, chunk := range h.chunks {
+			if chunk.Type == RecordData && len(chunk.Data) == 0 {
+				continue
+			}
+			chunk.ConnectionID = id
+			chunk.Remote = h == client
+			records = append(records, chunk)
+		}
+	}
+	if server == nil {
+		logger.Printf("Only one direction of the connection from %s was captured", client.addr)
+	}
+
+	records = append(records, &Record{Time: flow.end, ConnectionID: id, Type: RecordClose, Remote: true})
+
+	return records
+}
+
+// findFrameBoundary returns the offset of the first position in data from
+// which several consecutive plausible frame headers can be parsed.
+func findFrameBoundary(data []byte) (int, bool) {
+	for i := 0; i+frameHeaderLen <= len(data); i++ {
+		if plausibleFrames(data[i:]) {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+func plausibleFrames(data []byte) bool {
+	for n := 0; n < frameSyncDepth; n++ {
+		if len(data) == 0 {
+			return n > 0
+		}
+		if len(data) < frameHeaderLen {
+			return false
+		}
+
+		length := int(uint32(data[0])<<16 | uint32(data[1])<<8 | uint32(data[2]))
+		frameType := http2.FrameType(data[3])
+		flags := http2.Flags(data[4])
+		streamID := binary.BigEndian.Uint32(data[5:])
+
+		if streamID&(1<<31) != 0 {
+			return false
+		}
+		if frameType > http2.FrameContinuation {
+			return false
+		}
+
+		var allowed http2.Flags
+		for flag := range flagName[frameType] {
+			allowed |= flag
+		}
+		if flags&^allowed != 0 {
+			return false
+		}
+
+		switch frameType {
+		case http2.FrameSettings, http2.FramePing, http2.FrameGoAway:
+			if streamID != 0 {
+				return false
+			}
+		case http2.FrameWindowUpdate:
+		default:
+			if streamID == 0 {
+				return false
+			}
+		}
+
+		if len(data) < frameHeaderLen+length {
+			return n > 0
+		}
+		data = data[frameHeaderLen+length:]
+	}
+
+	return true
+}
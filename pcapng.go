@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pcapngBlockSHB = 0x0A0D0D0A
+	pcapngBlockIDB = 0x00000001
+	pcapngBlockEPB = 0x00000006
+
+	pcapngOptEnd     = 0
+	pcapngOptComment = 1
+	pcapngOptIfName  = 2
+	pcapngOptUserApp = 4
+
+	// Packets carry bare IPv4/IPv6 headers without a link layer.
+	pcapngLinkTypeRaw = 101
+
+	// Wireshark hands connections on the HTTP port to its HTTP dissector,
+	// which switches to HTTP/2 once it sees the connection preface. The
+	// server side of every synthetic flow uses this port so the capture can
+	// be opened without any further configuration.
+	pcapngServerPort = 80
+
+	pcapngMaxSegment = 32768
+	pcapngWindow     = 65535
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// PcapngWriter writes plaintext traffic into a pcapng file as synthetic
+// TCP segments. It is shared by all connections.
+type PcapngWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (pw *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	pad := (4 - len(body)%4) % 4
+	total := uint32(12 + len(body) + pad)
+
+	buf := make([]byte, 0, total)
+	buf = binary.LittleEndian.AppendUint32(buf, blockType)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+	buf = append(buf, body...)
+	buf = append(buf, make([]byte, pad)...)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	_, err := pw.w.Write(buf)
+	return err
+}
+
+// Close closes the underlying writer if it is an io.Closer. Packets written
+// after Close are dropped, so that no block is left incomplete.
+func (pw *PcapngWriter) Close() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	w := pw.w
+	pw.w = io.Discard
+
+	c, ok := w.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return c.Close()
+}
+
+func (pw *PcapngWriter) writePacket(packet []byte, comment string) {
+	ts := uint64(time.Now().UnixNano() / 1000)
+
+	body := make([]byte, 0, 20+len(packet)+len(comment)+16)
+	body = binary.LittleEndian.AppendUint32(body, 0)
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+	body = append(body, packet...)
+	body = append(body, make([]byte, (4-len(packet)%4)%4)...)
+	if comment != "" {
+		body = appendPcapngOption(body, pcapngOptComment, comment)
+		body = appendPcapngOption(body, pcapngOptEnd, "")
+	}
+
+	err := pw.writeBlock(pcapngBlockEPB, body)
+	if err != nil {
+		logger.Printf("Unable to write capture: %s", err)
+	}
+}
+
+// NewFlow starts a synthetic TCP connection between client and server and
+// writes its three-way handshake. The comment is attached to the SYN packet.
+func (pw *PcapngWriter) NewFlow(client net.Addr, server net.Addr, comment string) *PcapngFlow {
+	flow := &PcapngFlow{
+		writer:     pw,
+		clientIP:   client.(*net.TCPAddr).IP,
+		clientPort: uint16(client.(*net.TCPAddr).Port),
+		serverIP:   server.(*net.TCPAddr).IP,
+		serverPort: pcapngServerPort,
+	}
+
+	flow.writeSegment(true, tcpFlagSYN, nil, comment)
+	flow.clientSeq++
+
+	flow.writeSegment(false, tcpFlagSYN|tcpFlagACK, nil, "")
+	flow.serverSeq++
+
+	flow.writeSegment(true, tcpFlagACK, nil, "")
+
+	return flow
+}
+
+// PcapngFlow is one synthetic TCP connection in a capture.
+type PcapngFlow struct {
+	writer *PcapngWriter
+
+	clientIP   net.IP
+	clientPort uint16
+	serverIP   net.IP
+	serverPort uint16
+
+	clientSeq uint32
+	serverSeq uint32
+}
+
+// Write records data sent by the client (fromClient) or by the server.
+func (f *PcapngFlow) Write(data []byte, fromClient bool) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > pcapngMaxSegment {
+			n = pcapngMaxSegment
+		}
+
+		f.writeSegment(fromClient, tcpFlagPSH|tcpFlagACK, data[:n], "")
+		if fromClient {
+			f.clientSeq += uint32(n)
+		} else {
+			f.serverSeq += uint32(n)
+		}
+
+		data = data[n:]
+	}
+}
+
+// Close writes the FIN exchange that ends the flow.
+func (f *PcapngFlow) Close() {
+	f.writeSegment(true, tcpFlagFIN|tcpFlagACK, nil, "")
+	f.clientSeq++
+
+	f.writeSegment(false, tcpFlagFIN|tcpFlagACK, nil, "")
+	f.serverSeq++
+
+	f.writeSegment(true, tcpFlagACK, nil, "")
+}
+
+func (f *PcapngFlow) writeSegment(fromClient bool, flags uint8, payload []byte, comment string) {
+	srcIP, dstIP := f.clientIP, f.serverIP
+	srcPort, dstPort := f.clientPort, f.serverPort
+	seq, ack := f.clientSeq, f.serverSeq
+	if !fromClient {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = ack, seq
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+
+	v4 := srcIP.To4() != nil && dstIP.To4() != nil
+	if v4 {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	} else {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], pcapngWindow)
+	tcp = append(tcp, payload...)
+
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, srcIP...)
+	pseudo = append(pseudo, dstIP...)
+	if v4 {
+		pseudo = append(pseudo, 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(tcp)))
+	} else {
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(tcp)))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+	var ip []byte
+	if v4 {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000)
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], srcIP)
+		copy(ip[16:], dstIP)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], srcIP)
+		copy(ip[24:], dstIP)
+	}
+
+	f.writer.writePacket(append(ip, tcp...), comment)
+}
+
+func checksum(data ...[]byte) uint16 {
+	var sum uint32
+	var odd bool
+	var last byte
+
+	for _, d := range data {
+		for _, b := range d {
+			if odd {
+				sum += uint32(last)<<8 | uint32(b)
+			} else {
+				last = b
+			}
+			odd = !odd
+		}
+	}
+	if odd {
+		sum += uint32(last) << 8
+	}
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+
+	return ^uint16(sum)
+}
+
+func appendPcapngOption(buf []byte, code uint16, value string) []byte {
+	buf = binary.LittleEndian.AppendUint16(buf, code)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(value)))
+	buf = append(buf, value...)
+	buf = append(buf, make([]byte, (4-len(value)%4)%4)...)
+	return buf
+}
+
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	pw := &PcapngWriter{w: w}
+
+	shb := make([]byte, 0, 64)
+	shb = binary.LittleEndian.AppendUint32(shb, 0x1A2B3C4D)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, 0xFFFFFFFFFFFFFFFF)
+	shb = appendPcapngOption(shb, pcapngOptUserApp, "h2a "+VERSION)
+	shb = appendPcapngOption(shb, pcapngOptEnd, "")
+	err := pw.writeBlock(pcapngBlockSHB, shb)
+	if err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 0, 32)
+	idb = binary.LittleEndian.AppendUint16(idb, pcapngLinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	idb = appendPcapngOption(idb, pcapngOptIfName, "h2a")
+	idb = appendPcapngOption(idb, pcapngOptEnd, "")
+	err = pw.writeBlock(pcapngBlockIDB, idb)
+	if err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
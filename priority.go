@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// defaultWeight is the weight of streams without a priority (RFC 7540,
+// Section 5.3.5).
+const defaultWeight = 16
+
+// PriorityNode is a stream in the priority tree, with the streams that depend
+// on it. Weight is between 1 and 256, one more than the Weight field of the
+// frames.
+type PriorityNode struct {
+	StreamID uint32          `json:"stream_id"`
+	Weight   int             `json:"weight,omitempty"`
+	Children []*PriorityNode `json:"children,omitempty"`
+}
+
+type priorityStream struct {
+	parent   uint32
+	weight   int
+	children []uint32
+}
+
+// PriorityTree rebuilds the stream dependency tree of a connection from
+// HEADERS, PRIORITY and PUSH_PROMISE frames (RFC 7540, Section 5.3). Stream 0
+// is the root of the tree.
+type PriorityTree struct {
+	// Disabled is set when the server sends SETTINGS_NO_RFC7540_PRIORITIES,
+	// after which the priorities of frames are ignored (RFC 9218, Section
+	// 2.1).
+	Disabled bool
+
+	streams map[uint32]*priorityStream
+}
+
+// HandleFrame applies the priority information of a frame and reports
+// whether the tree changed.
+func (pt *PriorityTree) HandleFrame(frame http2.Frame) bool {
+	if pt.Disabled {
+		return false
+	}
+
+	streamID := frame.Header().StreamID
+
+	switch frame := frame.(type) {
+	case *http2.HeadersFrame:
+		if frame.HasPriority() {
+			return pt.prioritize(streamID, frame.Priority)
+		}
+		// Streams without a priority depend on the root, and trailers keep
+		// the priority of the stream.
+		_, ok := pt.streams[streamID]
+		if !ok {
+			pt.add(streamID, 0, defaultWeight)
+			return true
+		}
+
+	case *http2.PriorityFrame:
+		return pt.prioritize(streamID, frame.PriorityParam)
+
+	case *http2.PushPromiseFrame:
+		// Pushed streams depend on the stream they are associated with.
+		_, ok := pt.streams[frame.PromiseID]
+		if !ok {
+			_, ok = pt.streams[streamID]
+			if !ok {
+				pt.add(streamID, 0, defaultWeight)
+			}
+			pt.add(frame.PromiseID, streamID, defaultWeight)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Remove takes a closed stream out of the tree. The streams that depend on it
+// move to its parent and share its weight in proportion to their own
+// (RFC 7540, Section 5.3.4). It reports whether the tree changed.
+func (pt *PriorityTree) Remove(streamID uint32) bool {
+	s, ok := pt.streams[streamID]
+	if !ok || streamID == 0 {
+		return false
+	}
+
+	total := 0
+	for _, id := range s.children {
+		total += pt.streams[id].weight
+	}
+
+	for _, id := range s.children {
+		child := pt.streams[id]
+		child.weight = s.weight * child.weight / total
+		if child.weight < 1 {
+			child.weight = 1
+		}
+		pt.attach(id, s.parent)
+	}
+
+	pt.detach(streamID)
+	delete(pt.streams, streamID)
+
+	return true
+}
+
+// Root returns the tree from the root.
+func (pt *PriorityTree) Root() *PriorityNode {
+	return pt.node(0)
+}
+
+// Empty reports whether no stream is in the tree.
+func (pt *PriorityTree) Empty() bool {
+	return len(pt.streams) == 1
+}
+
+func (pt *PriorityTree) prioritize(streamID uint32, param http2.PriorityParam) bool {
+	// A stream cannot depend on itself (RFC 7540, Section 5.3.1).
+	if param.StreamDep == streamID {
+		return false
+	}
+
+	parentID := param.StreamDep
+	weight := int(param.Weight) + 1
+	exclusive := param.Exclusive
+
+	// A dependency on a stream that is not in the tree gives the default
+	// priority.
+	_, ok := pt.streams[parentID]
+	if !ok {
+		parentID = 0
+		weight = defaultWeight
+		exclusive = false
+	}
+
+	_, ok = pt.streams[streamID]
+	if !ok {
+		pt.add(streamID, parentID, weight)
+	} else {
+		// A stream that is made to depend on one of its own dependencies
+		// first moves that dependency to its former parent (RFC 7540,
+		// Section 5.3.3).
+		if pt.dependsOn(parentID, streamID) {
+			pt.attach(parentID, pt.streams[streamID].parent)
+		}
+		pt.streams[streamID].weight = weight
+		pt.attach(streamID, parentID)
+	}
+
+	// An exclusive dependency makes the stream the sole dependency of its
+	// parent, and the other dependencies of the parent depend on the stream.
+	if exclusive {
+		siblings := append([]uint32{}, pt.streams[parentID].children...)
+		for _, id := range siblings {
+			if id != streamID {
+				pt.attach(id, streamID)
+			}
+		}
+	}
+
+	return true
+}
+
+func (pt *PriorityTree) add(streamID uint32, parentID uint32, weight int) {
+	pt.streams[streamID] = &priorityStream{weight: weight}
+	pt.attach(streamID, parentID)
+}
+
+// attach moves a stream under a new parent, after its existing children.
+func (pt *PriorityTree) attach(streamID uint32, parentID uint32) {
+	pt.detach(streamID)
+
+	s := pt.streams[streamID]
+	s.parent = parentID
+	parent := pt.streams[parentID]
+	parent.children = append(parent.children, streamID)
+}
+
+func (pt *PriorityTree) detach(streamID uint32) {
+	parent, ok := pt.streams[pt.streams[streamID].parent]
+	if !ok {
+		return
+	}
+
+	for i, id := range parent.children {
+		if id == streamID {
+			parent.children = append(parent.children[:i:i], parent.children[i+1:]...)
+			break
+		}
+	}
+}
+
+// dependsOn reports whether a stream is a dependency, direct or not, of
+// another stream.
+func (pt *PriorityTree) dependsOn(streamID uint32, ancestorID uint32) bool {
+	for streamID != 0 {
+		streamID = pt.streams[streamID].parent
+		if streamID == ancestorID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (pt *PriorityTree) node(streamID uint32) *PriorityNode {
+	s := pt.streams[streamID]
+
+	n := &PriorityNode{StreamID: streamID}
+	if streamID != 0 {
+		n.Weight = s.weight
+	}
+	for _, id := range s.children {
+		n.Children = append(n.Children, pt.node(id))
+	}
+
+	return n
+}
+
+func NewPriorityTree() *PriorityTree {
+	return &PriorityTree{
+		streams: map[uint32]*priorityStream{
+			0: &priorityStream{},
+		},
+	}
+}
+
+// priorityTreeLines draws a priority tree as ASCII.
+func priorityTreeLines(root *PriorityNode) []string {
+	lines := []string{"  0"}
+
+	var draw func(n *PriorityNode, prefix string)
+	draw = func(n *PriorityNode, prefix string) {
+		for i, child := range n.Children {
+			branch, indent := "+- ", "|  "
+			if i == len(n.Children)-1 {
+				branch, indent = "`- ", "   "
+			}
+			lines = append(lines, fmt.Sprintf("  %s%s%d (Weight: %d)", prefix, branch, child.StreamID, child.Weight))
+			draw(child, prefix+indent)
+		}
+	}
+	draw(root, "")
+
+	return lines
+}
+
+// Default priority parameters (RFC 9218, Section 4).
+const (
+	defaultUrgency     = 3
+	defaultIncremental = false
+)
+
+// StreamPriority is the priority of a stream given by the priority header
+// field and PRIORITY_UPDATE frames (RFC 9218).
+type StreamPriority struct {
+	StreamID    uint32 `json:"stream_id"`
+	Urgency     int    `json:"urgency"`
+	Incremental bool   `json:"incremental"`
+}
+
+type extensiblePriority struct {
+	priority StreamPriority
+	request  bool
+	updated  bool
+}
+
+// ExtensiblePriorities follows the effective priority of the streams of a
+// connection.
+type ExtensiblePriorities struct {
+	streams map[uint32]*extensiblePriority
+}
+
+// HandleFrame applies the priority signals of a frame sent by the client if
+// remote is set, or by the server otherwise. It returns the effective
+// priority of the stream when the frame carries a priority signal.
+func (ep *ExtensiblePriorities) HandleFrame(e *Event, frame http2.Frame, remote bool) *StreamPriority {
+	streamID := frame.Header().StreamID
+
+	var headers HeaderFields
+	switch frame := frame.(type) {
+	case *http2.HeadersFrame:
+		headers = e.Frame.Payload.(HeadersFramePayload).HeaderFields
+	case *http2.ContinuationFrame:
+		headers = e.Frame.Payload.(ContinuationFramePayload).HeaderFields
+	case *http2.PriorityUpdateFrame:
+		if !remote {
+			return nil
+		}
+
+		// The frame replaces the priority of the stream, including the one of
+		// a request that has not been sent yet.
+		s := ep.stream(frame.PrioritizedStreamID)
+		s.priority = parsePriority(frame.Priority, NewStreamPriority(frame.PrioritizedStreamID))
+		s.updated = true
+
+		priority := s.priority
+		return &priority
+	default:
+		return nil
+	}
+
+	if !headers.Has("priority") {
+		return nil
+	}
+
+	s := ep.stream(streamID)
+	if remote {
+		// Trailers and requests reprioritized by PRIORITY_UPDATE keep their
+		// priority.
+		if !s.request && !s.updated {
+			s.priority = parsePriority(headers.Get("priority"), s.priority)
+		}
+		s.request = true
+	} else {
+		// The parameters sent by the server take precedence over the ones
+		// of the client (RFC 9218, Section 8).
+		s.priority = parsePriority(headers.Get("priority"), s.priority)
+	}
+
+	priority := s.priority
+	return &priority
+}
+
+// Remove forgets the priority of a closed stream.
+func (ep *ExtensiblePriorities) Remove(streamID uint32) {
+	delete(ep.streams, streamID)
+}
+
+func (ep *ExtensiblePriorities) stream(streamID uint32) *extensiblePriority {
+	s, ok := ep.streams[streamID]
+	if !ok {
+		s = &extensiblePriority{priority: NewStreamPriority(streamID)}
+		ep.streams[streamID] = s
+	}
+
+	return s
+}
+
+func NewExtensiblePriorities() *ExtensiblePriorities {
+	return &ExtensiblePriorities{
+		streams: map[uint32]*extensiblePriority{},
+	}
+}
+
+func NewStreamPriority(streamID uint32) StreamPriority {
+	return StreamPriority{
+		StreamID:    streamID,
+		Urgency:     defaultUrgency,
+		Incremental: defaultIncremental,
+	}
+}
+
+// parsePriority applies the parameters of a priority field value, which is
+// a structured field dictionary (RFC 8941), to a priority. Unknown
+// parameters and invalid values are ignored (RFC 9218, Section 4).
+func parsePriority(value string, priority StreamPriority) StreamPriority {
+	for _, member := range strings.Split(value, ",") {
+		member = strings.TrimSpace(member)
+
+		// Parameters of the members are not used.
+		member, _, _ = strings.Cut(member, ";")
+		key, v, hasValue := strings.Cut(member, "=")
+
+		switch key {
+		case "u":
+			urgency, err := strconv.Atoi(v)
+			if err == nil && urgency >= 0 && urgency <= 7 {
+				priority.Urgency = urgency
+			}
+		case "i":
+			switch {
+			case !hasValue || v == "?1":
+				priority.Incremental = true
+			case v == "?0":
+				priority.Incremental = false
+			}
+		}
+	}
+
+	return priority
+}
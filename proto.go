@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ProtoRegistry resolves gRPC methods to the message types of their
+// requests and responses.
+type ProtoRegistry struct {
+	files []*protoregistry.Files
+}
+
+// Method returns the method of a gRPC request path such as
+// "/helloworld.Greeter/SayHello", or nil if it is unknown.
+func (pr *ProtoRegistry) Method(path string) protoreflect.MethodDescriptor {
+	if pr == nil {
+		return nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 {
+		return nil
+	}
+
+	for _, files := range pr.files {
+		d, err := files.FindDescriptorByName(protoreflect.FullName(parts[0]))
+		if err != nil {
+			continue
+		}
+
+		sd, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			continue
+		}
+
+		md := sd.Methods().ByName(protoreflect.Name(parts[1]))
+		if md != nil {
+			return md
+		}
+	}
+
+	return nil
+}
+
+// LoadSet adds the files of a binary FileDescriptorSet, such as the output of
+// `protoc --include_imports -o`.
+func (pr *ProtoRegistry) LoadSet(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	err = proto.Unmarshal(b, set)
+	if err != nil {
+		return err
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return err
+	}
+
+	pr.files = append(pr.files, files)
+
+	return nil
+}
+
+// LoadDir compiles all .proto files in a directory. Imports are resolved
+// relative to the directory.
+func (pr *ProtoRegistry) LoadDir(dir string) error {
+	names := []string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".proto" {
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(name))
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no .proto files in %s", dir)
+	}
+
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			ImportPaths: []string{dir},
+		}),
+	}
+
+	compiled, err := compiler.Compile(context.Background(), names...)
+	if err != nil {
+		return err
+	}
+
+	files := &protoregistry.Files{}
+	for _, f := range compiled {
+		err = files.RegisterFile(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	pr.files = append(pr.files, files)
+
+	return nil
+}
+
+func NewProtoRegistry() *ProtoRegistry {
+	return &ProtoRegistry{
+		files: []*protoregistry.Files{},
+	}
+}
+
+// WireField is a field decoded from the protobuf wire format without a
+// schema.
+type WireField struct {
+	Number protowire.Number `json:"number"`
+	Type   string           `json:"type"`
+	Value  interface{}      `json:"value"`
+}
+
+// decodeGRPCMessage decodes the payload of a gRPC message, as JSON if the
+// message type of the method is known and as raw wire fields otherwise.
+func decodeGRPCMessage(protos *ProtoRegistry, path string, request bool, encoding string, msg *GRPCMessage) {
+	data := msg.Data
+	if msg.Compressed {
+		if encoding == "" {
+			msg.Error = "compressed message without grpc-encoding"
+			return
+		}
+
+		r, err := newContentDecoder(encoding, bytes.NewReader(data))
+		if err == nil {
+			data, err = io.ReadAll(r)
+			r.Close()
+		}
+		if err != nil {
+			msg.Error = err.Error()
+			return
+		}
+	}
+
+	md := protos.Method(path)
+	if md != nil {
+		desc := md.Output()
+		if request {
+			desc = md.Input()
+		}
+		msg.Type = string(desc.FullName())
+
+		m := dynamicpb.NewMessage(desc)
+		err := proto.Unmarshal(data, m)
+		if err == nil {
+			var j []byte
+			j, err = protojson.Marshal(m)
+			if err == nil {
+				// protojson randomizes its whitespace, so compact it.
+				var buf bytes.Buffer
+				err = json.Compact(&buf, j)
+				if err == nil {
+					msg.Payload = json.RawMessage(buf.Bytes())
+					return
+				}
+			}
+		}
+		msg.Error = err.Error()
+	}
+
+	fields, err := decodeWireFields(data)
+	if err != nil {
+		if msg.Error == "" {
+			msg.Error = err.Error()
+		}
+		return
+	}
+	msg.Fields = fields
+}
+
+func decodeWireFields(b []byte) ([]WireField, error) {
+	fields := []WireField{}
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		field := WireField{Number: num}
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			field.Type = "varint"
+			field.Value = v
+			b = b[n:]
+
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			field.Type = "fixed32"
+			field.Value = v
+			b = b[n:]
+
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			field.Type = "fixed64"
+			field.Value = v
+			b = b[n:]
+
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			field.Type = "bytes"
+			field.Value = wireBytesValue(v)
+			b = b[n:]
+
+		case protowire.StartGroupType:
+			v, n := protowire.ConsumeGroup(num, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			group, err := decodeWireFields(v)
+			if err != nil {
+				return nil, err
+			}
+			field.Type = "group"
+			field.Value = group
+			b = b[n:]
+
+		default:
+			return nil, fmt.Errorf("unexpected wire type %d for field %d", typ, num)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// wireBytesValue guesses the content of a length-delimited field: a
+// printable string, an embedded message, or raw bytes.
+func wireBytesValue(b []byte) interface{} {
+	if isPrintable(b) {
+		return string(b)
+	}
+
+	fields, err := decodeWireFields(b)
+	if err == nil {
+		return fields
+	}
+
+	return b
+}
+
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// wireFieldLines formats raw wire fields for the default formatter.
+func wireFieldLines(fields []WireField, indent string) []string {
+	lines := []string{}
+
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case []WireField:
+			lines = append(lines, fmt.Sprintf("%s%d (%s):", indent, f.Number, f.Type))
+			lines = append(lines, wireFieldLines(v, indent+"  ")...)
+		case string:
+			lines = append(lines, fmt.Sprintf("%s%d (%s): %q", indent, f.Number, f.Type, v))
+		case []byte:
+			lines = append(lines, fmt.Sprintf("%s%d (%s): 0x%x", indent, f.Number, f.Type, v))
+		default:
+			lines = append(lines, fmt.Sprintf("%s%d (%s): %d", indent, f.Number, f.Type, v))
+		}
+	}
+
+	return lines
+}
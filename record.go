@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	RecordConnect = "connect"
+	RecordData    = "data"
+	RecordClose   = "close"
+	RecordGap     = "gap"
+)
+
+// Record is a single entry of a recorded session. A session file is a
+// sequence of records encoded as JSON lines.
+type Record struct {
+	Time         int64  `json:"time"`
+	ConnectionID string `json:"connection_id"`
+	Type         string `json:"type"`
+	Remote       bool   `json:"remote"`
+	RemoteAddr   string `json:"remote_addr,omitempty"`
+	ServerName   string `json:"server_name,omitempty"`
+	Protocol     string `json:"protocol,omitempty"`
+	Data         []byte `json:"data,omitempty"`
+
+	// Length is the number of bytes missing from a capture at a gap record,
+	// and Skip the number of bytes after the gap that are skipped up to the
+	// next frame.
+	Length int64 `json:"length,omitempty"`
+	Skip   int64 `json:"skip,omitempty"`
+}
+
+// Recorder writes the records of all connections into a session file.
+type Recorder struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (r *Recorder) Write(rec *Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.encoder.Encode(rec)
+	if err != nil {
+		logger.Printf("Unable to write record: %s", err)
+	}
+}
+
+func (r *Recorder) Connect(connID string, addr net.Addr, serverName string, protocol string) {
+	r.Write(&Record{
+		Time:         time.Now().UnixNano(),
+		ConnectionID: connID,
+		Type:         RecordConnect,
+		Remote:       true,
+		RemoteAddr:   addr.String(),
+		ServerName:   serverName,
+		Protocol:     protocol,
+	})
+}
+
+func (r *Recorder) Data(connID string, chunk []byte, remote bool) {
+	r.Write(&Record{
+		Time:         time.Now().UnixNano(),
+		ConnectionID: connID,
+		Type:         RecordData,
+		Remote:       remote,
+		Data:         chunk,
+	})
+}
+
+func (r *Recorder) Close(connID string) {
+	r.Write(&Record{
+		Time:         time.Now().UnixNano(),
+		ConnectionID: connID,
+		Type:         RecordClose,
+		Remote:       true,
+	})
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// ReadRecords reads all records of a session file in the order in which
+// they were written.
+func ReadRecords(r io.Reader) ([]*Record, error) {
+	decoder := json.NewDecoder(r)
+	records := []*Record{}
+
+	for {
+		rec := &Record{}
+		err := decoder.Decode(rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+// GroupRecords groups records by connection, in the order in which the
+// connections were opened.
+func GroupRecords(records []*Record) [][]*Record {
+	conns := [][]*Record{}
+	index := map[string]int{}
+
+	for _, rec := range records {
+		i, ok := index[rec.ConnectionID]
+		if !ok {
+			i = len(conns)
+			index[rec.ConnectionID] = i
+			conns = append(conns, []*Record{})
+		}
+		conns[i] = append(conns[i], rec)
+	}
+
+	return conns
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Idle time to wait for more responses once everything has been resent.
+const replayLinger = 1 * time.Second
+
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	originPort := fs.String("P", "", "")
+	originHost := fs.String("H", "", "")
+	originDirect := fs.Bool("D", false, "")
+	dumpFlags := NewDumpFlags(fs)
+	speed := fs.Float64("s", 1, "")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [OPTIONS] FILE\n\n", os.Args[0])
+		fmt.Println("Options:")
+		fmt.Println("  -P:             Origin port")
+		fmt.Println("  -H:             Origin host")
+		fmt.Println("  -D:             Use HTTP/2 direct mode to connect origin")
+		fmt.Println("  -s:             Speed multiplier, 0 sends without delay (Default: 1)")
+		dumpFlags.Usage()
+		fmt.Println("  --help:         Display this help and exit.")
+		os.Exit(1)
+	}
+
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+	if *originPort == "" {
+		logger.Fatalln("Origin port is not specified")
+	}
+	if *originHost == "" {
+		logger.Fatalln("Origin host is not specified")
+	}
+	if *speed < 0 {
+		logger.Fatalln("Invalid speed multiplier")
+	}
+
+	originConfig := OriginConfig{
+		Addr:   net.JoinHostPort(*originHost, *originPort),
+		Direct: *originDirect,
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		logger.Fatalf("Unable to open record file: %s\n", err)
+	}
+	records, err := ReadRecords(f)
+	f.Close()
+	if err != nil {
+		logger.Fatalf("Invalid record file: %s\n", err)
+	}
+
+	conns := GroupRecords(records)
+	if len(conns) == 0 {
+		return
+	}
+
+	dumpConfig := dumpFlags.Config()
+	defer dumpConfig.Close()
+
+	replayer := &Replayer{
+		Origin: originConfig,
+		Dump:   dumpConfig,
+		Speed:  *speed,
+		epoch:  conns[0][0].Time,
+		start:  time.Now(),
+	}
+
+	var wg sync.WaitGroup
+	for _, records := range conns {
+		wg.Add(1)
+		go func(records []*Record) {
+			defer wg.Done()
+			replayer.Replay(records)
+		}(records)
+	}
+	wg.Wait()
+}
+
+// Replayer resends the client side of recorded connections to an origin,
+// keeping the original timing between them.
+type Replayer struct {
+	Origin OriginConfig
+	Dump   DumpConfig
+	Speed  float64
+
+	epoch int64
+	start time.Time
+}
+
+// wait returns a channel that fires when the record is due.
+func (r *Replayer) wait(rec *Record) <-chan time.Time {
+	var d time.Duration
+	if r.Speed > 0 {
+		offset := time.Duration(float64(rec.Time-r.epoch) / r.Speed)
+		d = time.Until(r.start.Add(offset))
+	}
+
+	return time.After(d)
+}
+
+func (r *Replayer) Replay(records []*Record) {
+	<-r.wait(records[0])
+
+	var protocol, serverName string
+	for _, rec := range records {
+		if rec.Type == RecordConnect {
+			protocol = rec.Protocol
+			serverName = rec.ServerName
+			break
+		}
+	}
+
+	var originConn net.Conn
+	var err error
+	if r.Origin.Direct {
+		originConn, err = net.Dial("tcp", r.Origin.Addr)
+	} else {
+		config := &tls.Config{}
+		config.ServerName = serverName
+		config.InsecureSkipVerify = true
+		if protocol != "" {
+			config.NextProtos = append(config.NextProtos, protocol)
+		}
+
+		originConn, err = tls.Dial("tcp", r.Origin.Addr, config)
+	}
+	if err != nil {
+		logger.Printf("Unable to connect to the origin: %s", err)
+		return
+	}
+
+	defer originConn.Close()
+
+	addr := originConn.LocalAddr()
+	dumper := NewFrameDumper(NewConnectionID(addr), addr, r.Dump)
+	dumper.Connect()
+	defer dumper.Close()
+
+	if tlsConn, ok := originConn.(*tls.Conn); ok {
+		dumper.DumpConnectionState(tlsConn.ConnectionState())
+	}
+
+	originCh, originErrCh := handleConnection(originConn)
+
+	pending := []*Record{}
+	for _, rec := range records {
+		if rec.Type == RecordClose || (rec.Type == RecordData && rec.Remote) {
+			pending = append(pending, rec)
+		}
+	}
+
+	var next <-chan time.Time
+	if len(pending) > 0 {
+		next = r.wait(pending[0])
+	}
+	var linger <-chan time.Time
+
+	for {
+		select {
+		case <-next:
+			rec := pending[0]
+			pending = pending[1:]
+
+			if rec.Type == RecordClose {
+				next = nil
+				linger = time.After(replayLinger)
+				continue
+			}
+
+			_, err := originConn.Write(rec.Data)
+			if err != nil {
+				logger.Printf("Unable to write data to the origin: %s", err)
+				return
+			}
+			dumper.DumpFrame(rec.Data, true)
+
+			if len(pending) > 0 {
+				next = r.wait(pending[0])
+			} else {
+				next = nil
+				linger = time.After(replayLinger)
+			}
+
+		case chunk := <-originCh:
+			dumper.DumpFrame(chunk, false)
+			if linger != nil {
+				linger = time.After(replayLinger)
+			}
+
+		case err := <-originErrCh:
+			if err != io.EOF {
+				logger.Printf("Origin error: %s", err)
+			}
+			return
+
+		case <-linger:
+			return
+		}
+	}
+}
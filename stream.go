@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/net/http2"
+)
+
+// Stream states (RFC 9113, Section 5.1).
+const (
+	StreamIdle             = "idle"
+	StreamReservedLocal    = "reserved (local)"
+	StreamReservedRemote   = "reserved (remote)"
+	StreamOpen             = "open"
+	StreamHalfClosedLocal  = "half-closed (local)"
+	StreamHalfClosedRemote = "half-closed (remote)"
+	StreamClosed           = "closed"
+)
+
+// StreamState is the state of a stream as seen by the client and by the
+// server. Previous is set when the frame changed the state.
+type StreamState struct {
+	Client StreamStateChange `json:"client"`
+	Server StreamStateChange `json:"server"`
+}
+
+type StreamStateChange struct {
+	State    string `json:"state"`
+	Previous string `json:"previous,omitempty"`
+}
+
+func (ssc StreamStateChange) String() string {
+	if ssc.Previous == "" {
+		return ssc.State
+	}
+	return fmt.Sprintf("%s -> %s", ssc.Previous, ssc.State)
+}
+
+// StreamSummary is a stream that was not closed when the connection closed.
+type StreamSummary struct {
+	StreamID uint32 `json:"stream_id"`
+	Client   string `json:"client"`
+	Server   string `json:"server"`
+}
+
+// stream holds what both endpoints know about a stream. The state of each
+// endpoint is derived from it.
+type stream struct {
+	reserved      bool
+	opened        bool
+	clientEnded   bool
+	serverEnded   bool
+	reset         bool
+	resetByClient bool
+}
+
+// state returns the state of the stream for the client if client is set, or
+// for the server otherwise.
+func (s *stream) state(client bool) string {
+	if s.reset || (s.clientEnded && s.serverEnded) {
+		return StreamClosed
+	}
+
+	if !s.opened {
+		if !s.reserved {
+			return StreamIdle
+		}
+		// Only servers reserve streams.
+		if client {
+			return StreamReservedRemote
+		}
+		return StreamReservedLocal
+	}
+
+	localEnded, peerEnded := s.clientEnded, s.serverEnded
+	if !client {
+		localEnded, peerEnded = peerEnded, localEnded
+	}
+
+	switch {
+	case localEnded:
+		return StreamHalfClosedLocal
+	case peerEnded:
+		return StreamHalfClosedRemote
+	}
+
+	return StreamOpen
+}
+
+// maxResetStreams is the number of reset streams that are kept to tell
+// frames in flight apart. Frames on older reset streams are taken as frames
+// on closed streams.
+const maxResetStreams = 100
+
+// StreamTracker follows the state of the streams of a connection.
+type StreamTracker struct {
+	streams map[uint32]*stream
+
+	// resetStreams holds the IDs of the reset streams that are kept, oldest
+	// first.
+	resetStreams []uint32
+
+	lastClientStreamID uint32
+	lastServerStreamID uint32
+}
+
+// HandleFrame applies a frame sent by the client if remote is set, or by
+// the server otherwise. It returns the state of the stream of the frame and
+// the problems found with the frame.
+func (st *StreamTracker) HandleFrame(frame http2.Frame, remote bool) (*StreamState, []Problem) {
+	streamID := frame.Header().StreamID
+	if streamID == 0 {
+		return nil, nil
+	}
+
+	s := st.stream(streamID)
+	before := StreamState{
+		Client: StreamStateChange{State: s.state(true)},
+		Server: StreamStateChange{State: s.state(false)},
+	}
+	sender := s.state(remote)
+	problems := []Problem{}
+
+	illegal := func(format string, args ...interface{}) {
+		problems = append(problems, newProblem("stream-state", format, args...))
+	}
+	invalidID := func(format string, args ...interface{}) {
+		problems = append(problems, newProblem("stream-id", format, args...))
+	}
+
+	// Frames sent before the sender learned about a reset by its peer are
+	// expected and ignored by the peer.
+	inFlight := s.reset && s.resetByClient != remote
+
+	switch frame := frame.(type) {
+	case *http2.HeadersFrame:
+		switch sender {
+		case StreamIdle:
+			if !remote {
+				illegal("HEADERS from server on stream %d that was not reserved", streamID)
+			} else if streamID%2 == 0 {
+				invalidID("HEADERS from client on even-numbered stream %d", streamID)
+			} else if streamID <= st.lastClientStreamID {
+				invalidID("HEADERS on stream %d after stream %d was opened", streamID, st.lastClientStreamID)
+			}
+			if remote && streamID > st.lastClientStreamID {
+				st.lastClientStreamID = streamID
+			}
+			s.opened = true
+		case StreamReservedLocal:
+			s.opened = true
+			s.clientEnded = true
+		case StreamReservedRemote:
+			illegal("HEADERS on stream %d in state %s", streamID, sender)
+		case StreamHalfClosedLocal:
+			illegal("HEADERS on stream %d after END_STREAM", streamID)
+		case StreamClosed:
+			if !inFlight {
+				invalidID("HEADERS on closed stream %d", streamID)
+			}
+		}
+		if frame.StreamEnded() {
+			st.end(s, remote)
+		}
+
+	case *http2.DataFrame:
+		switch sender {
+		case StreamIdle, StreamReservedLocal, StreamReservedRemote:
+			illegal("DATA on stream %d in state %s", streamID, sender)
+		case StreamHalfClosedLocal:
+			illegal("DATA on stream %d after END_STREAM", streamID)
+		case StreamClosed:
+			if !inFlight {
+				illegal("DATA on closed stream %d", streamID)
+			}
+		}
+		if frame.StreamEnded() {
+			st.end(s, remote)
+		}
+
+	case *http2.RSTStreamFrame:
+		switch sender {
+		case StreamIdle:
+			illegal("RST_STREAM on idle stream %d", streamID)
+		case StreamClosed:
+		default:
+			s.reset = true
+			s.resetByClient = remote
+			st.resetStreams = append(st.resetStreams, streamID)
+			if len(st.resetStreams) > maxResetStreams {
+				delete(st.streams, st.resetStreams[0])
+				st.resetStreams = st.resetStreams[1:]
+			}
+		}
+
+	case *http2.WindowUpdateFrame:
+		switch sender {
+		case StreamIdle, StreamReservedLocal:
+			illegal("WINDOW_UPDATE on stream %d in state %s", streamID, sender)
+		}
+
+	case *http2.PushPromiseFrame:
+		if remote {
+			illegal("PUSH_PROMISE from client on stream %d", streamID)
+		} else if sender != StreamOpen && sender != StreamHalfClosedRemote {
+			illegal("PUSH_PROMISE on stream %d in state %s", streamID, sender)
+		}
+
+		promised := st.stream(frame.PromiseID)
+		if promised.state(remote) != StreamIdle {
+			invalidID("PUSH_PROMISE reserves stream %d that is not idle", frame.PromiseID)
+		} else if frame.PromiseID%2 != 0 {
+			invalidID("PUSH_PROMISE reserves odd-numbered stream %d", frame.PromiseID)
+		} else {
+			promised.reserved = true
+			if frame.PromiseID > st.lastServerStreamID {
+				st.lastServerStreamID = frame.PromiseID
+			}
+		}
+		st.forget(frame.PromiseID, promised)
+	}
+
+	state := &StreamState{
+		Client: StreamStateChange{State: s.state(true)},
+		Server: StreamStateChange{State: s.state(false)},
+	}
+	if state.Client.State != before.Client.State {
+		state.Client.Previous = before.Client.State
+	}
+	if state.Server.State != before.Server.State {
+		state.Server.Previous = before.Server.State
+	}
+
+	st.forget(streamID, s)
+
+	return state, problems
+}
+
+// forget drops a stream that does not need to be kept. Streams closed by
+// END_STREAM on both sides are found by their stream ID, and idle streams,
+// such as the ones only named by PRIORITY frames, are the same as unknown
+// ones. Reset streams are kept so that frames in flight can be told apart.
+func (st *StreamTracker) forget(streamID uint32, s *stream) {
+	if (s.clientEnded && s.serverEnded && !s.reset) || s.state(true) == StreamIdle {
+		delete(st.streams, streamID)
+	}
+}
+
+// Upgrade opens stream 1 for the request that upgraded the connection from
+// HTTP/1.1, which the client has ended (RFC 7540, Section 3.2).
+func (st *StreamTracker) Upgrade() {
+	st.streams[1] = &stream{opened: true, clientEnded: true}
+	st.lastClientStreamID = 1
+}
+
+// OpenStreams returns the streams that are not closed, in order.
+func (st *StreamTracker) OpenStreams() []StreamSummary {
+	summaries := []StreamSummary{}
+
+	for id, s := range st.streams {
+		if s.state(true) == StreamClosed || s.state(true) == StreamIdle {
+			continue
+		}
+		summaries = append(summaries, StreamSummary{
+			StreamID: id,
+			Client:   s.state(true),
+			Server:   s.state(false),
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].StreamID < summaries[j].StreamID
+	})
+
+	return summaries
+}
+
+func (st *StreamTracker) end(s *stream, remote bool) {
+	if remote {
+		s.clientEnded = true
+	} else {
+		s.serverEnded = true
+	}
+}
+
+// stream returns the stream with the given ID. Streams that are not known
+// are idle, unless a higher stream of the same initiator has been used, in
+// which case they are closed (RFC 9113, Section 5.1.1).
+func (st *StreamTracker) stream(streamID uint32) *stream {
+	s, ok := st.streams[streamID]
+	if ok {
+		return s
+	}
+
+	s = &stream{}
+
+	last := st.lastClientStreamID
+	if streamID%2 == 0 {
+		last = st.lastServerStreamID
+	}
+	if streamID <= last {
+		s.opened = true
+		s.clientEnded = true
+		s.serverEnded = true
+		return s
+	}
+
+	st.streams[streamID] = s
+
+	return s
+}
+
+func NewStreamTracker() *StreamTracker {
+	return &StreamTracker{
+		streams: map[uint32]*stream{},
+	}
+}